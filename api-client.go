@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	tscg "github.com/tailscale/tailscale-client-go/tailscale"
+)
+
+var (
+	apiRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsmetrics_api_retries_total",
+		Help: "Tailscale API requests retried, by tailnet and endpoint",
+	}, []string{"tailnet", "endpoint"})
+
+	apiFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsmetrics_api_failures_total",
+		Help: "Tailscale API requests that failed after all the retries, by tailnet and endpoint",
+	}, []string{"tailnet", "endpoint"})
+)
+
+// retryTransport is an http.RoundTripper for the Tailscale API. It retries
+// 429s (honouring Retry-After), 5xx responses and network errors with
+// jittered exponential backoff and gives every attempt its own timeout. A
+// Retry-After longer than MaxDelay is not waited for, the request fails.
+type retryTransport struct {
+	// Tailnet is the tailnet label of the retry metrics, see forTailnet.
+	Tailnet    string
+	Base       http.RoundTripper
+	MaxRetries int
+	// BaseDelay is the wait before the first retry, doubled on every
+	// retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Timeout bounds each attempt, reading the body included.
+	Timeout time.Duration
+}
+
+func newRetryTransport(base http.RoundTripper) *retryTransport {
+	return &retryTransport{
+		Base:       base,
+		MaxRetries: *apiRetriesFlag,
+		BaseDelay:  time.Second,
+		MaxDelay:   30 * time.Second,
+		Timeout:    time.Duration(*apiTimeoutSecs) * time.Second,
+	}
+}
+
+// forTailnet returns a copy of t for the requests of tailnet. The copies
+// share the connections of Base.
+func (t *retryTransport) forTailnet(tailnet string) *retryTransport {
+	c := *t
+	c.Tailnet = tailnet
+	return &c
+}
+
+const defaultAPIBaseURL = "https://api.tailscale.com/api/v2"
+
+// newAPITransport returns the transport every Tailscale API consumer goes
+// through: retries on top of an http.Transport that trusts the CA bundle
+// (if any) besides the system roots and goes through proxyURL (if empty,
+// the proxy from the environment).
+func newAPITransport(caBundle, proxyURL string) (*retryTransport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if caBundle != "" {
+		pem, err := os.ReadFile(caBundle)
+		if err != nil {
+			return nil, fmt.Errorf("ca bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca bundle: no certificates found in %s", caBundle)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return newRetryTransport(t), nil
+}
+
+// apiEndpoint names the endpoint a request goes to for the metric labels:
+// the last segment of the path (devices, network-logs, token).
+func apiEndpoint(req *http.Request) string {
+	return path.Base(req.URL.Path)
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := apiEndpoint(req)
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.Body != nil && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := t.roundTrip(r)
+		wait, retry := t.retryAfter(resp, err)
+		if !retry || wait > t.MaxDelay || attempt >= t.MaxRetries || (req.Body != nil && req.GetBody == nil) {
+			if err != nil || resp.StatusCode >= 400 {
+				apiFailures.WithLabelValues(t.Tailnet, endpoint).Inc()
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if wait < 0 {
+			wait = t.backoff(attempt)
+		}
+		apiRetries.WithLabelValues(t.Tailnet, endpoint).Inc()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			apiFailures.WithLabelValues(t.Tailnet, endpoint).Inc()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// roundTrip makes a single attempt bounded by t.Timeout. The timeout is
+// released when the body is closed.
+func (t *retryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.Timeout <= 0 {
+		return t.Base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.Timeout)
+	resp, err := t.Base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// retryAfter tells if the attempt should be retried and how long to wait
+// before doing so. A negative wait means use the backoff.
+func (t *retryTransport) retryAfter(resp *http.Response, err error) (time.Duration, bool) {
+	if err != nil {
+		return -1, true
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()), true
+	}
+	if resp.StatusCode >= 500 {
+		return -1, true
+	}
+	return 0, false
+}
+
+// backoff returns the wait before retry number attempt+1: exponential
+// with equal jitter so concurrent clients do not retry in lockstep.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.BaseDelay << attempt
+	if d <= 0 || d > t.MaxDelay {
+		d = t.MaxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half)
+}
+
+// parseRetryAfter understands both forms of the header: delay in seconds
+// and HTTP date. It returns -1 when the header is missing or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return -1
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return -1
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Device is a tailnet device as the API lists it, with the node id
+// tscg.Device does not decode.
+type Device struct {
+	tscg.Device
+	NodeID string `json:"nodeId"`
+}
+
+// devicesClient lists the tailnet devices through our own http client so
+// the requests get the same retries as the rest of the API calls.
+type devicesClient struct {
+	client  *http.Client
+	baseURL string
+	tailnet string
+}
+
+func (d *devicesClient) Devices(ctx context.Context) ([]Device, error) {
+	apiUrl := fmt.Sprintf("%s/tailnet/%s/devices", d.baseURL, d.tailnet)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, transportError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, httpStatusError(resp.StatusCode, fmt.Errorf("devices: unexpected status code %d: %s", resp.StatusCode, b))
+	}
+
+	var r struct {
+		Devices []Device `json:"devices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, decodeError(fmt.Errorf("devices: %w", err))
+	}
+	return r.Devices, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRetryClient() *http.Client {
+	return &http.Client{Transport: &retryTransport{
+		Base:       http.DefaultTransport,
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   5 * time.Millisecond,
+		Timeout:    time.Second,
+	}}
+}
+
+func TestRetryTransport(t *testing.T) {
+	c := qt.New(t)
+
+	// 429, then 500, then ok
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch calls.Add(1) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer srv.Close()
+
+	retries := testutil.ToFloat64(apiRetries.WithLabelValues("", "retry-ok"))
+	resp, err := newTestRetryClient().Get(srv.URL + "/api/v2/retry-ok")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(calls.Load(), qt.Equals, int32(3))
+	c.Assert(testutil.ToFloat64(apiRetries.WithLabelValues("", "retry-ok"))-retries, qt.Equals, 2.0)
+
+	// Always failing: give up after MaxRetries and count the failure
+	calls.Store(0)
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	failures := testutil.ToFloat64(apiFailures.WithLabelValues("", "retry-fail"))
+	resp, err = newTestRetryClient().Get(failing.URL + "/api/v2/retry-fail")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusBadGateway)
+	c.Assert(calls.Load(), qt.Equals, int32(4))
+	c.Assert(testutil.ToFloat64(apiFailures.WithLabelValues("", "retry-fail"))-failures, qt.Equals, 1.0)
+
+	// A Retry-After longer than MaxDelay is not waited for
+	calls.Store(0)
+	throttled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer throttled.Close()
+
+	failures = testutil.ToFloat64(apiFailures.WithLabelValues("", "retry-throttled"))
+	resp, err = newTestRetryClient().Get(throttled.URL + "/api/v2/retry-throttled")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusTooManyRequests)
+	c.Assert(calls.Load(), qt.Equals, int32(1))
+	c.Assert(testutil.ToFloat64(apiFailures.WithLabelValues("", "retry-throttled"))-failures, qt.Equals, 1.0)
+
+	// Client errors are not retried
+	calls.Store(0)
+	forbidden := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbidden.Close()
+	resp, err = newTestRetryClient().Get(forbidden.URL + "/api/v2/retry-forbidden")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(calls.Load(), qt.Equals, int32(1))
+}
+
+func TestRetryTransportTimeout(t *testing.T) {
+	c := qt.New(t)
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := newTestRetryClient()
+	client.Transport.(*retryTransport).Timeout = 50 * time.Millisecond
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/api/v2/slow", nil)
+	c.Assert(err, qt.IsNil)
+	resp, err := client.Do(req)
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+	c.Assert(calls.Load(), qt.Equals, int32(2))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2022, 10, 28, 22, 40, 0, 0, time.UTC)
+	c.Assert(parseRetryAfter("", now), qt.Equals, time.Duration(-1))
+	c.Assert(parseRetryAfter("7", now), qt.Equals, 7*time.Second)
+	c.Assert(parseRetryAfter("Fri, 28 Oct 2022 22:40:30 GMT", now), qt.Equals, 30*time.Second)
+	c.Assert(parseRetryAfter("Fri, 28 Oct 2022 22:39:00 GMT", now), qt.Equals, time.Duration(0))
+	c.Assert(parseRetryAfter("soon", now), qt.Equals, time.Duration(-1))
+}
+
+func TestAPITransportCABundle(t *testing.T) {
+	c := qt.New(t)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"devices": [{"hostname": "hello", "id": "50052"}]}`))
+	}))
+	defer srv.Close()
+
+	// Without the CA the server is not trusted
+	transport, err := newAPITransport("", "")
+	c.Assert(err, qt.IsNil)
+	transport.MaxRetries = 0
+	client := &devicesClient{&http.Client{Transport: transport}, srv.URL + "/api/v2", "dummy"}
+	_, err = client.Devices(context.Background())
+	c.Assert(err, qt.ErrorMatches, ".*certificate.*")
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	c.Assert(os.WriteFile(bundle, cert, 0o600), qt.IsNil)
+	transport, err = newAPITransport(bundle, "")
+	c.Assert(err, qt.IsNil)
+	client.client = &http.Client{Transport: transport}
+	devices, err := client.Devices(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(devices[0].Hostname, qt.Equals, "hello")
+
+	_, err = newAPITransport(filepath.Join(t.TempDir(), "missing.pem"), "")
+	c.Assert(err, qt.ErrorMatches, "ca bundle: .*")
+}
+
+func TestAPITransportProxy(t *testing.T) {
+	c := qt.New(t)
+	var proxied atomic.Value
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A proxy gets the absolute URL in the request line
+		proxied.Store(r.URL.String())
+		w.Write([]byte(`{"devices": []}`))
+	}))
+	defer proxy.Close()
+
+	transport, err := newAPITransport("", proxy.URL)
+	c.Assert(err, qt.IsNil)
+	client := &devicesClient{&http.Client{Transport: transport}, "http://api.example.com/api/v2", "my-tailnet"}
+	_, err = client.Devices(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(proxied.Load(), qt.Equals, "http://api.example.com/api/v2/tailnet/my-tailnet/devices")
+}
+
+func TestAPIURLs(t *testing.T) {
+	c := qt.New(t)
+	a := AppConfig{}
+	c.Assert(a.apiBaseURL(), qt.Equals, "https://api.tailscale.com/api/v2")
+	c.Assert(a.tokenURL(), qt.Equals, "https://api.tailscale.com/api/v2/oauth/token")
+
+	a.APIBaseURL = "http://127.0.0.1:8080/api/v2/"
+	c.Assert(a.apiBaseURL(), qt.Equals, "http://127.0.0.1:8080/api/v2")
+	c.Assert(a.tokenURL(), qt.Equals, "http://127.0.0.1:8080/api/v2/oauth/token")
+
+	a.TokenURL = "http://127.0.0.1:9090/token"
+	c.Assert(a.tokenURL(), qt.Equals, "http://127.0.0.1:9090/token")
+}
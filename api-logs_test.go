@@ -7,14 +7,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/prometheus/client_golang/prometheus"
-
-	//"github.com/prometheus/client_golang/prometheus/testutil"
-	tscg "github.com/tailscale/tailscale-client-go/tailscale"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
@@ -39,8 +38,8 @@ func (f *FakeClientAPI) SetDevices(json []byte) {
 	f.DevicesJson = json
 }
 
-func (f *FakeClientAPI) Devices(ctx context.Context) ([]tscg.Device, error) {
-	resp := make(map[string][]tscg.Device)
+func (f *FakeClientAPI) Devices(ctx context.Context) ([]Device, error) {
+	resp := make(map[string][]Device)
 	err := json.Unmarshal(f.DevicesJson, &resp)
 	if err != nil {
 		fmt.Printf("ERR FakeClientAPI.Devices(): %s", err)
@@ -57,7 +56,7 @@ func (f *FakeClientLog) SetJson(jsonD []byte) {
 	f.JsonData = jsonD
 }
 
-func (f *FakeClientLog) Get(url string) (*http.Response, error) {
+func (f *FakeClientLog) Do(req *http.Request) (*http.Response, error) {
 	recorder := httptest.NewRecorder()
 	_, err := recorder.Write(f.JsonData)
 	if err != nil {
@@ -69,43 +68,51 @@ func (f *FakeClientLog) Get(url string) (*http.Response, error) {
 }
 
 var (
-	app      AppConfig
 	flClient FakeClientLog
 	faClient FakeClientAPI
 )
 
-func TestMain(m *testing.M) {
-	app = AppConfig{
-		APIMetrics:           map[string]*prometheus.GaugeVec{},
-		LogMetrics:           map[string]*prometheus.CounterVec{},
-		SleepIntervalSeconds: *waitTimeSecs,
-		LMData:               &LogMetricData{},
-	}
-	app.LMData.Init()
-	app.registerLogMetrics()
-	app.registerAPIMetrics()
+// testApp is the collector of a tailnet with its own registry, so the
+// tests do not see each other's series.
+type testApp struct {
+	*AppConfig
+	Registry *prometheus.Registry
+}
 
-	flClient = FakeClientLog{}
-	faClient = FakeClientAPI{}
+func newTestApp() testApp {
+	a := &AppConfig{
+		TailNetName: "dummy",
+		Schedules:   map[string]schedule{logsLoop: {Interval: time.Duration(*waitTimeSecs) * time.Second}},
+		LMData:      &LogMetricData{Tailnet: "dummy"},
+		Names:       &nameResolver{Tailnet: "dummy"},
+	}
+	a.LMData.Init()
+	reg := prometheus.NewRegistry()
+	a.registerMetrics(reg)
+	return testApp{a, reg}
+}
 
-	exitVal := m.Run()
-	os.Exit(exitVal)
+// newTestExporter returns an exporter of the tailnet of newTestApp.
+func newTestExporter() *exporter {
+	app := newTestApp()
+	return &exporter{Tailnets: []*AppConfig{app.AppConfig}, Registry: app.Registry}
 }
 
 func TestAPIMetrics(t *testing.T) {
-	app.LMData.Init()
+	app := newTestApp()
 
 	faClient.SetDevices(jsonDevices)
-	app.updateAPIMetrics(&faClient)
+	app.updateAPIMetrics(context.Background(), &faClient)
 
 	mName := "tailscale_hosts"
 	c := qt.New(t)
-	hostToMetric := gatherLabels("hostname", mName, t)
+	hostToMetric := gatherLabels(app.Registry, "hostname", mName, t)
 	c.Assert(len(hostToMetric), qt.Equals, 2)
 
 	// TODO: Pull this from the json truth
 	hello := hostToMetric["hello"]
-	c.Assert(len(hello), qt.Equals, 6)
+	c.Assert(len(hello), qt.Equals, 7)
+	c.Assert(hello["tailnet"], qt.Equals, "dummy")
 	c.Assert(hello["hostname"], qt.Equals, "hello")
 	c.Assert(hello["update_available"], qt.Equals, "false")
 	c.Assert(hello["os"], qt.Equals, "linux")
@@ -114,7 +121,7 @@ func TestAPIMetrics(t *testing.T) {
 	c.Assert(hello["client_version"], qt.Equals, "1.1.1")
 
 	foo := hostToMetric["foo"]
-	c.Assert(len(foo), qt.Equals, 6)
+	c.Assert(len(foo), qt.Equals, 7)
 	c.Assert(foo["hostname"], qt.Equals, "foo")
 	c.Assert(foo["update_available"], qt.Equals, "true")
 	c.Assert(foo["os"], qt.Equals, "macos")
@@ -123,53 +130,201 @@ func TestAPIMetrics(t *testing.T) {
 	c.Assert(foo["client_version"], qt.Equals, "2.2.2")
 }
 
+func TestDeviceGauges(t *testing.T) {
+	c := qt.New(t)
+	app := newTestApp()
+	faClient.SetDevices(jsonDevices)
+	c.Assert(app.updateAPIMetrics(context.Background(), &faClient), qt.IsNil)
+
+	gauge := func(name, id, hostname string) float64 {
+		v, ok := gatherValue(app.Registry, name, map[string]string{"id": id, "hostname": hostname}, t)
+		c.Assert(ok, qt.IsTrue, qt.Commentf("%s{id=%q}", name, id))
+		return v
+	}
+	c.Assert(gauge("tailscale_device_authorized", "50052", "hello"), qt.Equals, 1.0)
+	c.Assert(gauge("tailscale_device_blocks_incoming_connections", "50053", "foo"), qt.Equals, 0.0)
+	c.Assert(gauge("tailscale_device_key_expiry_disabled", "50053", "foo"), qt.Equals, 1.0)
+	c.Assert(gauge("tailscale_device_created_timestamp_seconds", "50053", "foo"), qt.Equals, 1646500227.0)
+	c.Assert(gauge("tailscale_device_key_expiry_timestamp_seconds", "50053", "foo"), qt.Equals, 1662052227.0)
+	lastSeen := time.Date(2022, 4, 15, 13, 25, 21, 0, time.UTC)
+	c.Assert(gauge("tailscale_device_last_seen_age_seconds", "50053", "foo") >= time.Since(lastSeen).Seconds()-60, qt.IsTrue)
+
+	// hello has no creation nor expiry time
+	c.Assert(testutil.CollectAndCount(app.Devices, "tailscale_device_created_timestamp_seconds"), qt.Equals, 1)
+	c.Assert(testutil.CollectAndCount(app.Devices, "tailscale_device_key_expiry_timestamp_seconds"), qt.Equals, 1)
+	c.Assert(testutil.CollectAndCount(app.Devices, "tailscale_device_authorized"), qt.Equals, 2)
+}
+
+func TestAPIMetricsStaleSeries(t *testing.T) {
+	c := qt.New(t)
+	app := newTestApp()
+	mName := "tailscale_hosts"
+
+	faClient.SetDevices(jsonDevices)
+	c.Assert(app.updateAPIMetrics(context.Background(), &faClient), qt.IsNil)
+	c.Assert(len(gatherLabels(app.Registry, "hostname", mName, t)), qt.Equals, 2)
+
+	// hello upgrades its client and foo is deleted
+	var resp map[string][]Device
+	c.Assert(json.Unmarshal(jsonDevices, &resp), qt.IsNil)
+	hello := resp["devices"][0]
+	hello.ClientVersion = "1.2.0"
+	b, err := json.Marshal(map[string][]Device{"devices": {hello}})
+	c.Assert(err, qt.IsNil)
+	faClient.SetDevices(b)
+	c.Assert(app.updateAPIMetrics(context.Background(), &faClient), qt.IsNil)
+
+	hostToMetric := gatherLabels(app.Registry, "hostname", mName, t)
+	c.Assert(len(hostToMetric), qt.Equals, 1)
+	c.Assert(hostToMetric["hello"]["client_version"], qt.Equals, "1.2.0")
+	c.Assert(testutil.CollectAndCount(app.Devices, mName), qt.Equals, 1)
+	c.Assert(testutil.CollectAndCount(app.Devices, "tailscale_device_authorized"), qt.Equals, 1)
+}
+
 func TestLogMetrics(t *testing.T) {
-	app.LMData.Init()
+	app := newTestApp()
 
 	flClient.SetJson(logOne)
-	app.getNewLogData(&flClient)
+	app.getNewLogData(context.Background(), &flClient)
 	app.consumeNewLogData()
 
 	mName := "tailscale_tx_packets"
 	c := qt.New(t)
-	srcToMetric := gatherLabels("src", mName, t)
+	srcToMetric := gatherLabels(app.Registry, "src", mName, t)
 	c.Assert(len(srcToMetric), qt.Equals, 3)
 
 	src := "100.111.22.33"
 
-	checkValues(src, mName, t, 40.0)
+	checkValues(app.Registry, src, mName, t, 40.0)
 
 	mName = "tailscale_rx_packets"
-	checkValues(src, mName, t, 22.0)
+	checkValues(app.Registry, src, mName, t, 22.0)
 
 	mName = "tailscale_tx_bytes"
-	checkValues(src, mName, t, 3.0)
+	checkValues(app.Registry, src, mName, t, 3.0)
 
 	mName = "tailscale_rx_bytes"
-	checkValues(src, mName, t, 60.0)
+	checkValues(app.Registry, src, mName, t, 60.0)
 
 	// Make a new call to get new counters and check again the metric values
 	// the second log file matches the first one so the values should just double.
 	flClient.SetJson(logTwo)
-	app.getNewLogData(&flClient)
+	app.getNewLogData(context.Background(), &flClient)
 	app.consumeNewLogData()
 
 	mName = "tailscale_tx_packets"
-	checkValues(src, mName, t, 80.0)
+	checkValues(app.Registry, src, mName, t, 80.0)
 
 	mName = "tailscale_rx_packets"
-	checkValues(src, mName, t, 622.0)
+	checkValues(app.Registry, src, mName, t, 622.0)
 
 	mName = "tailscale_tx_bytes"
-	checkValues(src, mName, t, 5.0)
+	checkValues(app.Registry, src, mName, t, 5.0)
 
 	mName = "tailscale_rx_bytes"
-	checkValues(src, mName, t, 260.0)
+	checkValues(app.Registry, src, mName, t, 260.0)
+}
+
+func TestLogCursor(t *testing.T) {
+	c := qt.New(t)
+	a := AppConfig{Schedules: map[string]schedule{logsLoop: {Interval: time.Minute}}, LMData: &LogMetricData{}}
+	a.LMData.Init()
+	// The messages of logOne are logged within a second
+	a.LogOverlapSeconds = 1
+
+	now := time.Date(2022, 10, 28, 22, 41, 0, 0, time.UTC)
+	start, end := a.logWindow(now)
+	c.Assert(start, qt.Equals, now.Add(-time.Minute))
+	c.Assert(end, qt.Equals, now)
+
+	flClient.SetJson(logOne)
+	a.getNewLogData(context.Background(), &flClient)
+	c.Assert(len(a.LMData.data) > 0, qt.IsTrue)
+	lastLogged := time.Date(2022, 10, 28, 22, 40, 0, 344979725, time.UTC)
+	c.Assert(a.Cursor.Equal(lastLogged), qt.IsTrue)
+
+	start, _ = a.logWindow(now)
+	c.Assert(start.Equal(lastLogged.Add(-time.Second)), qt.IsTrue)
+
+	// The same messages coming back in the overlap must not be counted
+	// again
+	a.LMData.Init()
+	a.getNewLogData(context.Background(), &flClient)
+	c.Assert(len(a.LMData.data), qt.Equals, 0)
+	c.Assert(a.Cursor.Equal(lastLogged), qt.IsTrue)
 }
 
-func checkValues(src, mName string, t *testing.T, expected float64) {
+func TestLateMessages(t *testing.T) {
 	c := qt.New(t)
-	val, found := getMetricValueWithSrc(src, mName, t)
+	fake := newFakeAPI(t, "late-tailnet", "late-id", "late-secret")
+	var logs APILogResponse
+	c.Assert(json.Unmarshal(logOne, &logs), qt.IsNil)
+	now := time.Now()
+	fake.AddLogs(shiftLogs(logs.Logs, now.Add(-time.Minute))...)
+	newApp := func() *AppConfig {
+		a := &AppConfig{
+			APIBaseURL:   fake.APIURL(),
+			Transport:    newTestRetryClient().Transport,
+			TailNetName:  fake.Tailnet,
+			ClientId:     fake.ClientID,
+			ClientSecret: fake.ClientSecret,
+			LMData:       &LogMetricData{Tailnet: fake.Tailnet},
+			Traffic:      newTrafficCollector(LabelsConfig{}),
+			// Late by up to five minutes
+			LogOverlapSeconds: 300,
+		}
+		a.LMData.Init()
+		return a
+	}
+	a := newApp()
+	a.Cursor = now.Add(-2 * time.Minute)
+	ctx := context.Background()
+	c.Assert(a.getNewLogData(ctx, a.getOAuthClient(ctx)), qt.IsNil)
+	c.Assert(a.LMData.data, qt.Not(qt.HasLen), 0)
+	cursor := a.Cursor
+
+	// A message logged before the cursor shows up late, the overlap picks
+	// it up and the set skips the others
+	late := shiftLogs(logs.Logs[:1], cursor.Add(-30*time.Second))
+	fake.AddLogs(late...)
+	dups := testutil.ToFloat64(duplicateMessages.WithLabelValues(fake.Tailnet))
+	a.LMData.Init()
+	c.Assert(a.getNewLogData(ctx, a.getOAuthClient(ctx)), qt.IsNil)
+	want := LogMetricData{}
+	want.Init()
+	want.SaveNewData(APILogResponse{Logs: late})
+	c.Assert(a.LMData.data, qt.DeepEquals, want.data)
+	c.Assert(testutil.ToFloat64(duplicateMessages.WithLabelValues(fake.Tailnet))-dups, qt.Equals, float64(len(logs.Logs)))
+	c.Assert(a.Cursor, qt.Equals, cursor)
+
+	// After a restart the overlap was counted by the previous run
+	b := newApp()
+	c.Assert(b.restoreState(TailnetState{Cursor: cursor}), qt.IsNil)
+	c.Assert(b.getNewLogData(ctx, b.getOAuthClient(ctx)), qt.IsNil)
+	c.Assert(b.LMData.data, qt.HasLen, 0)
+}
+
+func TestLogWindowDelay(t *testing.T) {
+	c := qt.New(t)
+	a := AppConfig{Schedules: map[string]schedule{logsLoop: {Interval: time.Minute}}, LogDelaySeconds: 60, LMData: &LogMetricData{}}
+	a.LMData.Init()
+	now := time.Date(2022, 10, 28, 22, 41, 0, 0, time.UTC)
+	start, end := a.logWindow(now)
+	c.Assert(end, qt.Equals, now.Add(-time.Minute))
+	c.Assert(start, qt.Equals, now.Add(-2*time.Minute))
+
+	// A window without messages moves the cursor to its end, never to now
+	a.advanceCursor(time.Time{}, end)
+	c.Assert(a.Cursor, qt.Equals, now.Add(-time.Minute))
+	start, end = a.logWindow(now.Add(45 * time.Second))
+	c.Assert(start, qt.Equals, a.Cursor)
+	// The next poll is a single request with the default window size
+	c.Assert(splitWindow(start, end, 300*time.Second), qt.HasLen, 1)
+}
+
+func checkValues(g prometheus.Gatherer, src, mName string, t *testing.T, expected float64) {
+	c := qt.New(t)
+	val, found := getMetricValueWithSrc(g, src, mName, t)
 	fmt.Printf("\n%f, %t\n", val, found)
 	c.Assert(found, qt.Equals, true)
 	c.Assert(val, qt.Equals, expected)
@@ -177,26 +332,27 @@ func checkValues(src, mName string, t *testing.T, expected float64) {
 
 func TestResolveNames(t *testing.T) {
 	c := qt.New(t)
-	app.LMData.Init()
+	app := newTestApp()
 
 	flClient.SetJson(jsonDevicesTwo)
 	tailNet := "dummy"
-	app.NamesByAddr = mustMakeNamesByAddr(&tailNet, &flClient)
+	err := app.Names.Resolve(context.Background(), defaultAPIBaseURL, tailNet, &flClient)
+	c.Assert(err, qt.IsNil)
 
 	flClient.SetJson(logThree)
-	app.getNewLogData(&flClient)
+	app.getNewLogData(context.Background(), &flClient)
 	app.consumeNewLogData()
 
 	mName := "tailscale_tx_packets"
 	src := "hello"
-	val, found := getMetricValueWithSrc(src, mName, t)
+	val, found := getMetricValueWithSrc(app.Registry, src, mName, t)
 	fmt.Printf("\n%f, %t\n", val, found)
 	c.Assert(found, qt.Equals, true)
 	c.Assert(val, qt.Equals, 130.0)
 }
 
-func getMetricValueWithSrc(src, mName string, t *testing.T) (float64, bool) {
-	metrics, err := prometheus.DefaultGatherer.Gather()
+func getMetricValueWithSrc(g prometheus.Gatherer, src, mName string, t *testing.T) (float64, bool) {
+	metrics, err := g.Gather()
 	if err != nil {
 		t.Fatalf("Error gathering metrics: name: %s err=%s", mName, err)
 	}
@@ -218,8 +374,8 @@ func getMetricValueWithSrc(src, mName string, t *testing.T) (float64, bool) {
 	return 0.0, false
 }
 
-func gatherLabels(key, mName string, t *testing.T) map[string]map[string]string {
-	metrics, err := prometheus.DefaultGatherer.Gather()
+func gatherLabels(g prometheus.Gatherer, key, mName string, t *testing.T) map[string]map[string]string {
+	metrics, err := g.Gather()
 	if err != nil {
 		t.Fatalf("Error gathering metrics: key: %s, name: %s err=%s", key, mName, err)
 	}
@@ -239,3 +395,63 @@ func gatherLabels(key, mName string, t *testing.T) map[string]map[string]string
 
 	return hostToMetric
 }
+
+// gatherValue returns the value of the series of mName that has the labels.
+func gatherValue(g prometheus.Gatherer, mName string, labels map[string]string, t *testing.T) (float64, bool) {
+	metrics, err := g.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: name: %s err=%s", mName, err)
+	}
+	for _, mf := range metrics {
+		if mf.GetName() != mName {
+			continue
+		}
+	next:
+		for _, metric := range mf.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if v, ok := labels[label.GetName()]; ok && v != label.GetValue() {
+					continue next
+				}
+			}
+			if metric.Gauge != nil {
+				return metric.Gauge.GetValue(), true
+			}
+			return metric.Counter.GetValue(), true
+		}
+	}
+	return 0, false
+}
+
+// BenchmarkPollCycle is a whole network logs poll: decode the response,
+// aggregate, update the counters and scrape /metrics.
+func BenchmarkPollCycle(b *testing.B) {
+	quietLogs(b)
+	for _, nodes := range benchLogSizes {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			cfg := defaultLogGenConfig()
+			cfg.Nodes = nodes
+			body, err := json.Marshal(generateLogs(cfg))
+			if err != nil {
+				b.Fatal(err)
+			}
+			client := &FakeClientLog{JsonData: body}
+			a := newTestApp()
+			a.Schedules[logsLoop] = schedule{Interval: time.Second}
+			scrape := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			handler := promhttp.HandlerFor(a.Registry, promhttp.HandlerOpts{})
+			b.ReportAllocs()
+			for b.Loop() {
+				b.StopTimer()
+				a.Cursor = time.Time{}
+				a.LMData = &LogMetricData{}
+				a.LMData.Init()
+				b.StartTimer()
+				if err := a.getNewLogData(context.Background(), client); err != nil {
+					b.Fatal(err)
+				}
+				a.consumeNewLogData()
+				handler.ServeHTTP(httptest.NewRecorder(), scrape)
+			}
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The collectors below own the state behind the traffic and device metrics
+// and turn it into const metrics at scrape time. A series exists exactly as
+// long as the collector has state for it.
+
+// trafficKey is the label values of a traffic series.
+type trafficKey struct {
+	Src         string
+	Dst         string
+	TrafficType string
+	Proto       string
+	SrcPort     string
+	DstPort     string
+	Service     string
+	Reporter    string
+}
+
+// trafficCollector exports the cumulative traffic counters.
+type trafficCollector struct {
+	txBytes   *prometheus.Desc
+	rxBytes   *prometheus.Desc
+	txPackets *prometheus.Desc
+	rxPackets *prometheus.Desc
+	// drop are the labels not exported, the traffic of the series that
+	// only differ in them is added up
+	drop map[string]bool
+	// services names the ports of the service label
+	services map[uint16]string
+
+	mu     sync.Mutex
+	series map[trafficKey]LogCounts
+	// maxSeries is the series budget of every metric, no limit when 0.
+	// See fold.
+	maxSeries int
+	// folded are the series folded into other, their traffic goes
+	// straight there. It maps them to the last poll they had traffic in
+	// and forgets them foldedPolls polls later.
+	folded map[trafficKey]int
+	polls  int
+}
+
+// foldedPolls is how many polls without traffic a folded series is
+// remembered for. One that shows up after that is a new series.
+const foldedPolls = 12
+
+// trafficLabels are the labels of the traffic metrics, in the order of
+// trafficKey.
+var trafficLabels = []string{"src", "dst", "traffic_type", "proto", "src_port", "dst_port", "service", "reporter"}
+
+// optionalLabels are the traffic labels that are only exported when asked
+// for. The states before them do not have them.
+var optionalLabels = []string{"src_port", "dst_port", "service", "reporter"}
+
+func newTrafficCollector(cfg LabelsConfig) *trafficCollector {
+	drop := slices.Clone(cfg.Drop)
+	if !cfg.SrcPort {
+		drop = append(drop, "src_port")
+	}
+	if !cfg.DstPort {
+		drop = append(drop, "dst_port")
+	}
+	if !cfg.Service {
+		drop = append(drop, "service")
+	}
+	if !cfg.Reporter {
+		drop = append(drop, "reporter")
+	}
+	var labels []string
+	for _, l := range trafficLabels {
+		if !slices.Contains(drop, l) {
+			labels = append(labels, l)
+		}
+	}
+	t := &trafficCollector{
+		txBytes:   prometheus.NewDesc(txBytesMetric, "Total number of bytes transmitted", labels, nil),
+		rxBytes:   prometheus.NewDesc(rxBytesMetric, "Total number of bytes received", labels, nil),
+		txPackets: prometheus.NewDesc(txPacketsMetric, "Total number of packets transmitted", labels, nil),
+		rxPackets: prometheus.NewDesc(rxPacketsMetric, "Total number of packets received", labels, nil),
+		series:    map[trafficKey]LogCounts{},
+		folded:    map[trafficKey]int{},
+		drop:      map[string]bool{},
+		services:  cfg.services(),
+	}
+	for _, l := range drop {
+		t.drop[l] = true
+	}
+	return t
+}
+
+// labelValues returns the values of the labels that are not dropped.
+func (t *trafficCollector) labelValues(k trafficKey) []string {
+	lvs := make([]string, 0, len(trafficLabels))
+	for i, v := range [...]string{k.Src, k.Dst, k.TrafficType, k.Proto, k.SrcPort, k.DstPort, k.Service, k.Reporter} {
+		if !t.drop[trafficLabels[i]] {
+			lvs = append(lvs, v)
+		}
+	}
+	return lvs
+}
+
+// dropLabels empties the dropped labels of k.
+func (t *trafficCollector) dropLabels(k trafficKey) trafficKey {
+	for name, v := range k.fields() {
+		if t.drop[name] {
+			*v = ""
+		}
+	}
+	return k
+}
+
+// fields returns the fields of k by label name.
+func (k *trafficKey) fields() map[string]*string {
+	return map[string]*string{
+		"src":          &k.Src,
+		"dst":          &k.Dst,
+		"traffic_type": &k.TrafficType,
+		"proto":        &k.Proto,
+		"src_port":     &k.SrcPort,
+		"dst_port":     &k.DstPort,
+		"service":      &k.Service,
+		"reporter":     &k.Reporter,
+	}
+}
+
+func (t *trafficCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.txBytes
+	ch <- t.rxBytes
+	ch <- t.txPackets
+	ch <- t.rxPackets
+}
+
+func (t *trafficCollector) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, c := range t.series {
+		lvs := t.labelValues(k)
+		ch <- prometheus.MustNewConstMetric(t.txBytes, prometheus.CounterValue, float64(c.TxBytes), lvs...)
+		ch <- prometheus.MustNewConstMetric(t.rxBytes, prometheus.CounterValue, float64(c.RxBytes), lvs...)
+		ch <- prometheus.MustNewConstMetric(t.txPackets, prometheus.CounterValue, float64(c.TxPackets), lvs...)
+		ch <- prometheus.MustNewConstMetric(t.rxPackets, prometheus.CounterValue, float64(c.RxPackets), lvs...)
+	}
+}
+
+// protoNames are the IANA keywords (lowercase) of the protocols we name,
+// the rest are labeled with their number.
+var protoNames = map[uint8]string{
+	1:   "icmp",
+	2:   "igmp",
+	4:   "ipip",
+	6:   "tcp",
+	17:  "udp",
+	41:  "ipv6",
+	47:  "gre",
+	50:  "esp",
+	51:  "ah",
+	58:  "icmpv6",
+	89:  "ospf",
+	103: "pim",
+	112: "vrrp",
+	132: "sctp",
+	136: "udplite",
+}
+
+// protoLabels are the label values of every protocol number, so we do not
+// format one per entry. 0 is what the entries without a protocol (some
+// physical traffic) have.
+var protoLabels = func() (labels [256]string) {
+	for i := range labels {
+		labels[i] = cmp.Or(protoNames[uint8(i)], strconv.Itoa(i))
+	}
+	labels[0] = "-"
+	return labels
+}()
+
+// protoLabel returns the label value of a proto label of the states
+// before the names, a number.
+func protoLabel(s string) string {
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return s
+	}
+	return protoLabels[n]
+}
+
+// Add adds the traffic aggregated in a poll to the counters, labeling the
+// addresses and the reporters with their names when we know them. It
+// returns how many series were folded to stay within the budget.
+func (t *trafficCollector) Add(data MapLogEntryToValue, namesByAddr map[netip.Addr]string, namesByNode map[string]string) int {
+	// The same addresses show up in many entries
+	labels := make(map[netip.Addr]string)
+	label := func(addr netip.Addr) string {
+		l, ok := labels[addr]
+		if !ok {
+			l = addrLabel(addr, namesByAddr)
+			labels[addr] = l
+		}
+		return l
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.polls++
+	for le, c := range data {
+		k := trafficKey{
+			label(le.Src), label(le.Dst), le.TrafficType.String(), protoLabels[le.Proto],
+			le.SrcPort.String(), le.DstPort.String(), serviceLabel(le.Service, t.services),
+			nodeLabel(le.Reporter, namesByNode),
+		}
+		if len(t.drop) > 0 {
+			k = t.dropLabels(k)
+		}
+		if _, ok := t.folded[k]; ok {
+			t.folded[k] = t.polls
+			k = t.otherKey(k)
+		}
+		t.add(k, c)
+	}
+	for k, poll := range t.folded {
+		if t.polls-poll >= foldedPolls {
+			delete(t.folded, k)
+		}
+	}
+	return t.fold()
+}
+
+func (t *trafficCollector) add(k trafficKey, c LogCounts) {
+	s := t.series[k]
+	s.TxBytes += c.TxBytes
+	s.RxBytes += c.RxBytes
+	s.TxPackets += c.TxPackets
+	s.RxPackets += c.RxPackets
+	t.series[k] = s
+}
+
+// otherLabel is the value of the labels of the series folded into other.
+const otherLabel = "other"
+
+// otherKey is the series k is folded into. Only the traffic type is kept,
+// so there are at most four of them.
+func (t *trafficCollector) otherKey(k trafficKey) trafficKey {
+	o := trafficKey{otherLabel, otherLabel, k.TrafficType, otherLabel, otherLabel, otherLabel, otherLabel, otherLabel}
+	return t.dropLabels(o)
+}
+
+// SetMaxSeries sets the series budget and folds the series over it. A
+// bigger budget, or none, lets the series folded so far come back.
+func (t *trafficCollector) SetMaxSeries(n int) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n <= 0 || n > t.maxSeries {
+		clear(t.folded)
+	}
+	t.maxSeries = n
+	return t.fold()
+}
+
+// Fold folds the series over the budget, after Restore.
+func (t *trafficCollector) Fold() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.fold()
+}
+
+// Len returns the number of series of every metric.
+func (t *trafficCollector) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.series)
+}
+
+// fold keeps the series within maxSeries by adding the ones with the
+// least bytes into the other series of their traffic type. The totals do
+// not change, the series folded are no longer exported and their traffic
+// goes to other from then on (see folded). It returns how many series were
+// folded.
+func (t *trafficCollector) fold() int {
+	if t.maxSeries <= 0 || len(t.series) <= t.maxSeries {
+		return 0
+	}
+	type sortKey struct {
+		k      trafficKey
+		volume uint64
+		lvs    []string
+	}
+	keys := make([]sortKey, 0, len(t.series))
+	for k, c := range t.series {
+		if k != t.otherKey(k) {
+			keys = append(keys, sortKey{k, c.TxBytes + c.RxBytes, t.labelValues(k)})
+		}
+	}
+	slices.SortFunc(keys, func(a, b sortKey) int {
+		return cmp.Or(cmp.Compare(a.volume, b.volume), slices.Compare(a.lvs, b.lvs))
+	})
+	folded := 0
+	// The other series count too, with a budget smaller than them
+	// everything ends up folded.
+	for _, sk := range keys {
+		if len(t.series) <= t.maxSeries {
+			break
+		}
+		c := t.series[sk.k]
+		delete(t.series, sk.k)
+		t.add(t.otherKey(sk.k), c)
+		t.folded[sk.k] = t.polls
+		folded++
+	}
+	return folded
+}
+
+// counter returns the field of c that backs the metric.
+func counter(c *LogCounts, metric string) *uint64 {
+	switch metric {
+	case txBytesMetric:
+		return &c.TxBytes
+	case rxBytesMetric:
+		return &c.RxBytes
+	case txPacketsMetric:
+		return &c.TxPackets
+	case rxPacketsMetric:
+		return &c.RxPackets
+	}
+	return nil
+}
+
+// Samples returns the value of every series by metric name, for the state
+// file.
+func (t *trafficCollector) Samples() map[string][]CounterSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	samples := map[string][]CounterSample{}
+	for _, metric := range []string{txBytesMetric, rxBytesMetric, txPacketsMetric, rxPacketsMetric} {
+		samples[metric] = []CounterSample{}
+	}
+	for k, c := range t.series {
+		for metric := range samples {
+			samples[metric] = append(samples[metric], CounterSample{
+				Labels: map[string]string{
+					"src":          k.Src,
+					"dst":          k.Dst,
+					"traffic_type": k.TrafficType,
+					"proto":        k.Proto,
+					"src_port":     k.SrcPort,
+					"dst_port":     k.DstPort,
+					"service":      k.Service,
+					"reporter":     k.Reporter,
+				},
+				Value: float64(*counter(&c, metric)),
+			})
+		}
+	}
+	return samples
+}
+
+// Restore adds a sample of a previous run to the counters.
+func (t *trafficCollector) Restore(metric string, sample CounterSample) error {
+	var k trafficKey
+	found := 0
+	for name, v := range k.fields() {
+		l, ok := sample.Labels[name]
+		if !ok {
+			if slices.Contains(optionalLabels, name) {
+				continue
+			}
+			return fmt.Errorf("missing label %q", name)
+		}
+		*v = l
+		found++
+	}
+	if len(sample.Labels) != found {
+		return fmt.Errorf("unexpected labels %v", sample.Labels)
+	}
+	k = t.dropLabels(k)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.series[k]
+	p := counter(&c, metric)
+	if p == nil {
+		return fmt.Errorf("unknown metric %s", metric)
+	}
+	*p += uint64(sample.Value)
+	t.series[k] = c
+	return nil
+}
+
+// nodeLabel is the label value of a node id: its name if we know it, "-"
+// if it is empty.
+func nodeLabel(id string, namesByNode map[string]string) string {
+	if id == "" {
+		return "-"
+	}
+	if name, ok := namesByNode[id]; ok {
+		return name
+	}
+	return id
+}
+
+// reporterCollector counts the network log messages of every node. The
+// known devices that never sent one are exported with 0, so the nodes that
+// are not sending flow logs stand out.
+type reporterCollector struct {
+	messages *prometheus.Desc
+
+	mu sync.Mutex
+	// counts are by node id, the reporter label is the current name
+	counts map[string]uint64
+	names  map[string]string
+}
+
+func newReporterCollector() *reporterCollector {
+	return &reporterCollector{
+		messages: prometheus.NewDesc("tailscale_reporter_messages_total",
+			"Network log messages ingested by the node that logged them", []string{"node_id", "reporter"}, nil),
+		counts: map[string]uint64{},
+	}
+}
+
+func (r *reporterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.messages
+}
+
+func (r *reporterCollector) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, n := range r.counts {
+		ch <- prometheus.MustNewConstMetric(r.messages, prometheus.CounterValue, float64(n), cmp.Or(id, "-"), nodeLabel(id, r.names))
+	}
+}
+
+// Add adds the messages of every node id in a poll to the counters. Every
+// node in namesByNode gets a series, the ones without messages that are no
+// longer there are dropped.
+func (r *reporterCollector) Add(messages map[string]uint64, namesByNode map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = namesByNode
+	for id, n := range r.counts {
+		if _, ok := namesByNode[id]; !ok && n == 0 {
+			delete(r.counts, id)
+		}
+	}
+	for id := range namesByNode {
+		if _, ok := r.counts[id]; !ok {
+			r.counts[id] = 0
+		}
+	}
+	for id, n := range messages {
+		r.counts[id] += n
+	}
+}
+
+// deviceCollector exports the devices of the last successful refresh.
+type deviceCollector struct {
+	hosts             *prometheus.Desc
+	lastSeenAge       *prometheus.Desc
+	keyExpiry         *prometheus.Desc
+	created           *prometheus.Desc
+	authorized        *prometheus.Desc
+	blocksIncoming    *prometheus.Desc
+	keyExpiryDisabled *prometheus.Desc
+
+	// now is time.Now, tests replace it
+	now func() time.Time
+
+	mu      sync.Mutex
+	devices []Device
+}
+
+func newDeviceCollector() *deviceCollector {
+	hostLabels := []string{"hostname", "update_available", "os", "is_external", "user", "client_version"}
+	deviceLabels := []string{"id", "node_id", "hostname"}
+	return &deviceCollector{
+		hosts:             prometheus.NewDesc("tailscale_hosts", "Hosts in the tailnet", hostLabels, nil),
+		lastSeenAge:       prometheus.NewDesc("tailscale_device_last_seen_age_seconds", "Seconds since the device was last seen", deviceLabels, nil),
+		keyExpiry:         prometheus.NewDesc("tailscale_device_key_expiry_timestamp_seconds", "Unix time when the device key expires", deviceLabels, nil),
+		created:           prometheus.NewDesc("tailscale_device_created_timestamp_seconds", "Unix time when the device was added to the tailnet", deviceLabels, nil),
+		authorized:        prometheus.NewDesc("tailscale_device_authorized", "1 if the device is authorized", deviceLabels, nil),
+		blocksIncoming:    prometheus.NewDesc("tailscale_device_blocks_incoming_connections", "1 if the device blocks incoming connections", deviceLabels, nil),
+		keyExpiryDisabled: prometheus.NewDesc("tailscale_device_key_expiry_disabled", "1 if key expiry is disabled for the device", deviceLabels, nil),
+		now:               time.Now,
+	}
+}
+
+// Set replaces the devices. The ones that are gone, and the old labels of
+// the ones that changed, are no longer exported.
+func (d *deviceCollector) Set(devices []Device) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.devices = devices
+}
+
+func (d *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.hosts
+	ch <- d.lastSeenAge
+	ch <- d.keyExpiry
+	ch <- d.created
+	ch <- d.authorized
+	ch <- d.blocksIncoming
+	ch <- d.keyExpiryDisabled
+}
+
+func (d *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+
+	gauge := func(desc *prometheus.Desc, v float64, lvs ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, lvs...)
+	}
+	// Timestamps the API does not know about (zero) are not exported.
+	timestamp := func(desc *prometheus.Desc, t time.Time, lvs ...string) {
+		if !t.IsZero() {
+			gauge(desc, float64(t.Unix()), lvs...)
+		}
+	}
+	boolean := func(desc *prometheus.Desc, b bool, lvs ...string) {
+		v := 0.0
+		if b {
+			v = 1
+		}
+		gauge(desc, v, lvs...)
+	}
+
+	// Devices with the same hostname and attributes are one host series
+	hosts := map[[6]string]bool{}
+	for _, dev := range d.devices {
+		h := [6]string{
+			dev.Hostname,
+			strconv.FormatBool(dev.UpdateAvailable),
+			dev.OS,
+			strconv.FormatBool(dev.IsExternal),
+			dev.User,
+			dev.ClientVersion,
+		}
+		if !hosts[h] {
+			hosts[h] = true
+			gauge(d.hosts, 1, h[:]...)
+		}
+
+		if !dev.LastSeen.IsZero() {
+			gauge(d.lastSeenAge, now.Sub(dev.LastSeen.Time).Seconds(), dev.ID, dev.NodeID, dev.Hostname)
+		}
+		timestamp(d.keyExpiry, dev.Expires.Time, dev.ID, dev.NodeID, dev.Hostname)
+		timestamp(d.created, dev.Created.Time, dev.ID, dev.NodeID, dev.Hostname)
+		boolean(d.authorized, dev.Authorized, dev.ID, dev.NodeID, dev.Hostname)
+		boolean(d.blocksIncoming, dev.BlocksIncomingConnections, dev.ID, dev.NodeID, dev.Hostname)
+		boolean(d.keyExpiryDisabled, dev.KeyExpiryDisabled, dev.ID, dev.NodeID, dev.Hostname)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTrafficCollector(t *testing.T) {
+	c := qt.New(t)
+	mData := LogMetricData{}
+	mData.Init()
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:1111", "100.2.2.2:80", 1, 2, 3, 4}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{17, "100.1.1.1:1111", "bogus", 10, 20, 30, 40}, SubnetTraffic, "")
+
+	tc := newTrafficCollector(LabelsConfig{})
+	names := map[netip.Addr]string{netip.MustParseAddr("100.1.1.1"): "one"}
+	tc.Add(mData.data, names, nil)
+	tc.Add(mData.data, names, nil)
+
+	want := `
+# HELP tailscale_rx_packets Total number of packets received
+# TYPE tailscale_rx_packets counter
+tailscale_rx_packets{dst="-",proto="udp",src="one",traffic_type="subnet"} 60
+tailscale_rx_packets{dst="100.2.2.2",proto="tcp",src="one",traffic_type="virtual"} 6
+# HELP tailscale_tx_bytes Total number of bytes transmitted
+# TYPE tailscale_tx_bytes counter
+tailscale_tx_bytes{dst="-",proto="udp",src="one",traffic_type="subnet"} 40
+tailscale_tx_bytes{dst="100.2.2.2",proto="tcp",src="one",traffic_type="virtual"} 4
+`
+	c.Assert(testutil.CollectAndCompare(tc, strings.NewReader(want), "tailscale_rx_packets", "tailscale_tx_bytes"), qt.IsNil)
+	c.Assert(testutil.CollectAndCount(tc), qt.Equals, 8)
+}
+
+func TestTrafficCollectorRestore(t *testing.T) {
+	c := qt.New(t)
+	tc := newTrafficCollector(LabelsConfig{})
+	labels := map[string]string{"src": "a", "dst": "b", "traffic_type": "virtual", "proto": "6"}
+	c.Assert(tc.Restore(txBytesMetric, CounterSample{labels, 10}), qt.IsNil)
+	c.Assert(tc.Restore(txBytesMetric, CounterSample{labels, 5}), qt.IsNil)
+	c.Assert(tc.series[trafficKey{"a", "b", "virtual", "6", "", "", "", ""}], qt.Equals, LogCounts{TxBytes: 15})
+
+	c.Assert(tc.Restore("tailscale_nope", CounterSample{labels, 1}), qt.ErrorMatches, "unknown metric.*")
+	c.Assert(tc.Restore(txBytesMetric, CounterSample{map[string]string{"src": "a"}, 1}), qt.ErrorMatches, "missing label.*")
+	labels["nope"] = "x"
+	c.Assert(tc.Restore(txBytesMetric, CounterSample{labels, 1}), qt.ErrorMatches, "unexpected labels.*")
+}
+
+func TestProtoLabels(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(protoLabels[6], qt.Equals, "tcp")
+	c.Assert(protoLabels[17], qt.Equals, "udp")
+	c.Assert(protoLabels[58], qt.Equals, "icmpv6")
+	c.Assert(protoLabels[0], qt.Equals, "-")
+	c.Assert(protoLabels[250], qt.Equals, "250")
+	c.Assert(protoLabel("132"), qt.Equals, "sctp")
+	c.Assert(protoLabel("tcp"), qt.Equals, "tcp")
+}
+
+func TestTrafficCollectorReporter(t *testing.T) {
+	c := qt.New(t)
+	mData := LogMetricData{Reporter: true}
+	mData.Init()
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:1111", "10.0.0.1:80", 1, 2, 3, 4}, SubnetTraffic, "nRouter")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:1111", "10.0.0.1:80", 1, 2, 3, 4}, SubnetTraffic, "nOther")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:1111", "10.0.0.1:80", 1, 2, 3, 4}, SubnetTraffic, "")
+
+	tc := newTrafficCollector(LabelsConfig{Reporter: true})
+	tc.Add(mData.data, nil, map[string]string{"nRouter": "router"})
+	want := `
+# HELP tailscale_tx_bytes Total number of bytes transmitted
+# TYPE tailscale_tx_bytes counter
+tailscale_tx_bytes{dst="10.0.0.1",proto="tcp",reporter="-",src="100.1.1.1",traffic_type="subnet"} 2
+tailscale_tx_bytes{dst="10.0.0.1",proto="tcp",reporter="nOther",src="100.1.1.1",traffic_type="subnet"} 2
+tailscale_tx_bytes{dst="10.0.0.1",proto="tcp",reporter="router",src="100.1.1.1",traffic_type="subnet"} 2
+`
+	c.Assert(testutil.CollectAndCompare(tc, strings.NewReader(want), "tailscale_tx_bytes"), qt.IsNil)
+}
+
+func TestReporterCollector(t *testing.T) {
+	c := qt.New(t)
+	rc := newReporterCollector()
+	namesByNode := map[string]string{"nRouter": "router", "nQuiet": "quiet"}
+	rc.Add(map[string]uint64{"nRouter": 3, "nUnknown": 1}, namesByNode)
+	rc.Add(map[string]uint64{"nRouter": 2}, namesByNode)
+	want := `
+# HELP tailscale_reporter_messages_total Network log messages ingested by the node that logged them
+# TYPE tailscale_reporter_messages_total counter
+tailscale_reporter_messages_total{node_id="nQuiet",reporter="quiet"} 0
+tailscale_reporter_messages_total{node_id="nRouter",reporter="router"} 5
+tailscale_reporter_messages_total{node_id="nUnknown",reporter="nUnknown"} 1
+`
+	c.Assert(testutil.CollectAndCompare(rc, strings.NewReader(want)), qt.IsNil)
+
+	// A renamed device keeps its series, a deleted one without messages
+	// goes away
+	rc.Add(nil, map[string]string{"nRouter": "gateway"})
+	want = `
+# HELP tailscale_reporter_messages_total Network log messages ingested by the node that logged them
+# TYPE tailscale_reporter_messages_total counter
+tailscale_reporter_messages_total{node_id="nRouter",reporter="gateway"} 5
+tailscale_reporter_messages_total{node_id="nUnknown",reporter="nUnknown"} 1
+`
+	c.Assert(testutil.CollectAndCompare(rc, strings.NewReader(want)), qt.IsNil)
+}
+
+func TestTrafficCollectorDropLabels(t *testing.T) {
+	c := qt.New(t)
+	tc := newTrafficCollector(LabelsConfig{Drop: []string{"src", "proto"}})
+	tc.Add(MapLogEntryToValue{
+		{netip.MustParseAddr("100.1.1.1"), netip.MustParseAddr("100.2.2.2"), VirtualTraffic, 6, 0, 0, 0, ""}:  {TxBytes: 10},
+		{netip.MustParseAddr("100.1.1.3"), netip.MustParseAddr("100.2.2.2"), VirtualTraffic, 17, 0, 0, 0, ""}: {TxBytes: 5},
+	}, nil, nil)
+	// A sample saved before the labels were dropped is added up too
+	labels := map[string]string{"src": "a", "dst": "100.2.2.2", "traffic_type": "virtual", "proto": "6"}
+	c.Assert(tc.Restore(txBytesMetric, CounterSample{labels, 1}), qt.IsNil)
+
+	want := `
+# HELP tailscale_tx_bytes Total number of bytes transmitted
+# TYPE tailscale_tx_bytes counter
+tailscale_tx_bytes{dst="100.2.2.2",traffic_type="virtual"} 16
+`
+	c.Assert(testutil.CollectAndCompare(tc, strings.NewReader(want), "tailscale_tx_bytes"), qt.IsNil)
+}
+
+func TestTrafficCollectorFold(t *testing.T) {
+	c := qt.New(t)
+	tc := newTrafficCollector(LabelsConfig{})
+	c.Assert(tc.SetMaxSeries(3), qt.Equals, 0)
+	entry := func(src string, tt TrafficType) LogEntry {
+		return LogEntry{netip.MustParseAddr(src), netip.MustParseAddr("100.2.2.2"), tt, 6, 0, 0, 0, ""}
+	}
+	folded := tc.Add(MapLogEntryToValue{
+		entry("100.1.1.1", VirtualTraffic): {TxBytes: 100, RxBytes: 100},
+		entry("100.1.1.2", VirtualTraffic): {TxBytes: 50},
+		entry("100.1.1.3", VirtualTraffic): {TxBytes: 1, RxPackets: 1},
+		entry("100.1.1.4", VirtualTraffic): {TxBytes: 2},
+		entry("100.1.1.5", SubnetTraffic):  {RxBytes: 3},
+	}, nil, nil)
+	// The smallest go first, the other series count towards the budget
+	c.Assert(folded, qt.Equals, 4)
+	c.Assert(tc.Len(), qt.Equals, 3)
+
+	want := `
+# HELP tailscale_tx_bytes Total number of bytes transmitted
+# TYPE tailscale_tx_bytes counter
+tailscale_tx_bytes{dst="100.2.2.2",proto="tcp",src="100.1.1.1",traffic_type="virtual"} 100
+tailscale_tx_bytes{dst="other",proto="other",src="other",traffic_type="subnet"} 0
+tailscale_tx_bytes{dst="other",proto="other",src="other",traffic_type="virtual"} 53
+`
+	c.Assert(testutil.CollectAndCompare(tc, strings.NewReader(want), "tailscale_tx_bytes"), qt.IsNil)
+	other := tc.otherKey(trafficKey{TrafficType: "virtual"})
+	c.Assert(tc.series[other], qt.Equals, LogCounts{TxBytes: 53, RxPackets: 1})
+
+	// The traffic of a folded series goes to other from then on, it is
+	// not folded again
+	c.Assert(tc.Add(MapLogEntryToValue{entry("100.1.1.3", VirtualTraffic): {TxBytes: 700}}, nil, nil), qt.Equals, 0)
+	c.Assert(tc.series[other].TxBytes, qt.Equals, uint64(753))
+	c.Assert(tc.Len(), qt.Equals, 3)
+
+	// A new series bigger than one that was there pushes it out for good
+	c.Assert(tc.Add(MapLogEntryToValue{entry("100.1.1.6", VirtualTraffic): {TxBytes: 500}}, nil, nil), qt.Equals, 1)
+	c.Assert(tc.Add(MapLogEntryToValue{
+		entry("100.1.1.6", VirtualTraffic): {TxBytes: 1},
+		entry("100.1.1.1", VirtualTraffic): {TxBytes: 1000},
+	}, nil, nil), qt.Equals, 0)
+	c.Assert(tc.series[other].TxBytes, qt.Equals, uint64(753+100+1000))
+	c.Assert(tc.Len(), qt.Equals, 3)
+
+	// The folded series without traffic for foldedPolls polls are
+	// forgotten, one that comes back after that is a new series
+	for range foldedPolls {
+		c.Assert(tc.Add(MapLogEntryToValue{entry("100.1.1.3", VirtualTraffic): {TxBytes: 1}}, nil, nil), qt.Equals, 0)
+	}
+	c.Assert(tc.folded, qt.HasLen, 1)
+	c.Assert(tc.Add(MapLogEntryToValue{entry("100.1.1.2", VirtualTraffic): {TxBytes: 5000}}, nil, nil), qt.Equals, 1)
+	c.Assert(tc.series[tc.dropLabels(trafficKey{"100.1.1.2", "100.2.2.2", "virtual", "tcp", "", "", "", ""})].TxBytes, qt.Equals, uint64(5000))
+
+	// Without a budget nothing is folded and the folded series come back
+	c.Assert(tc.SetMaxSeries(0), qt.Equals, 0)
+	tc.Add(MapLogEntryToValue{entry("100.1.1.3", VirtualTraffic): {TxBytes: 7}}, nil, nil)
+	c.Assert(tc.Len(), qt.Equals, 4)
+}
+
+func TestDeviceCollector(t *testing.T) {
+	c := qt.New(t)
+	var resp map[string][]Device
+	c.Assert(json.Unmarshal(jsonDevices, &resp), qt.IsNil)
+	devices := resp["devices"]
+
+	dc := newDeviceCollector()
+	dc.now = func() time.Time { return time.Date(2022, 4, 15, 13, 26, 21, 0, time.UTC) }
+	c.Assert(testutil.CollectAndCount(dc), qt.Equals, 0)
+
+	dc.Set(devices)
+	want := `
+# HELP tailscale_device_last_seen_age_seconds Seconds since the device was last seen
+# TYPE tailscale_device_last_seen_age_seconds gauge
+tailscale_device_last_seen_age_seconds{hostname="foo",id="50053",node_id="n50053CNTRL"} 60
+tailscale_device_last_seen_age_seconds{hostname="hello",id="50052",node_id="n50052CNTRL"} 101
+`
+	c.Assert(testutil.CollectAndCompare(dc, strings.NewReader(want), "tailscale_device_last_seen_age_seconds"), qt.IsNil)
+
+	// Two devices with the same attributes are one host
+	twin := devices[0]
+	twin.ID = "50054"
+	dc.Set(append(devices, twin))
+	c.Assert(testutil.CollectAndCount(dc, "tailscale_hosts"), qt.Equals, 2)
+	c.Assert(testutil.CollectAndCount(dc, "tailscale_device_authorized"), qt.Equals, 3)
+
+	// Devices that are gone are no longer exported
+	dc.Set(devices[:1])
+	c.Assert(testutil.CollectAndCount(dc, "tailscale_hosts"), qt.Equals, 1)
+	c.Assert(testutil.CollectAndCount(dc, "tailscale_device_authorized"), qt.Equals, 1)
+}
+
+func BenchmarkTrafficCollectorAdd(b *testing.B) {
+	quietLogs(b)
+	for _, nodes := range benchLogSizes {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			cfg := defaultLogGenConfig()
+			cfg.Nodes = nodes
+			m := LogMetricData{}
+			m.Init()
+			m.SaveNewData(generateLogs(cfg))
+			namesByAddr := map[netip.Addr]string{}
+			for i := range nodes {
+				namesByAddr[nodeAddr(i)] = fmt.Sprintf("node-%d", i)
+			}
+			tc := newTrafficCollector(LabelsConfig{})
+			// Measure updating the series, not creating them
+			tc.Add(m.data, namesByAddr, nil)
+			b.ReportAllocs()
+			for b.Loop() {
+				tc.Add(m.data, namesByAddr, nil)
+			}
+		})
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tailscale/hujson"
+)
+
+// Config is what --config points to, a HuJSON file (JSON with comments and
+// trailing commas). Every setting missing from the file keeps the value of
+// its flag or env var.
+type Config struct {
+	Tailnet     string            `json:"tailnet"`
+	Credentials CredentialsConfig `json:"credentials"`
+	Intervals   IntervalsConfig   `json:"intervals"`
+	// Tailnets are the tailnets collected, when empty the one of Tailnet,
+	// Credentials and Intervals. See tailnets.
+	Tailnets []TailnetConfig `json:"tailnets"`
+	Listen   ListenConfig    `json:"listen"`
+	Labels   LabelsConfig    `json:"labels"`
+	Names    NamesConfig     `json:"names"`
+	Limits   LimitsConfig    `json:"limits"`
+	// TrafficTypes are the traffic types aggregated, all of them when
+	// empty.
+	TrafficTypes []string    `json:"traffic_types"`
+	Sinks        SinksConfig `json:"sinks"`
+}
+
+// CredentialsConfig is the OAuth client. The _file variants are read on
+// every (re)load, handy for mounted secrets.
+type CredentialsConfig struct {
+	ClientID         string `json:"client_id"`
+	ClientSecret     string `json:"client_secret"`
+	ClientIDFile     string `json:"client_id_file"`
+	ClientSecretFile string `json:"client_secret_file"`
+}
+
+// TailnetConfig is one of the tailnets collected. Without credentials it
+// uses the top-level ones, and the same for every schedule without an
+// interval.
+type TailnetConfig struct {
+	Name        string              `json:"name"`
+	Credentials CredentialsConfig   `json:"credentials"`
+	Intervals   LoopIntervalsConfig `json:"intervals"`
+}
+
+// LoopIntervalsConfig are the schedules of the collection loops.
+type LoopIntervalsConfig struct {
+	Logs    ScheduleConfig `json:"logs"`
+	Devices ScheduleConfig `json:"devices"`
+	Names   ScheduleConfig `json:"names"`
+}
+
+// IntervalsConfig are the schedules of the collection loops and how often
+// the state is saved.
+type IntervalsConfig struct {
+	LoopIntervalsConfig
+	Checkpoint duration `json:"checkpoint"`
+}
+
+// ScheduleConfig is a schedule, either just the interval ("30s") or
+// {"interval": "30s", "jitter": "5s", "align": true}.
+type ScheduleConfig struct {
+	Interval duration `json:"interval"`
+	Jitter   duration `json:"jitter"`
+	Align    bool     `json:"align"`
+}
+
+func (s *ScheduleConfig) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 || b[0] != '{' {
+		return s.Interval.UnmarshalJSON(b)
+	}
+	// Without the method, so we do not end up here again
+	type plain ScheduleConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(s))
+}
+
+func (s ScheduleConfig) schedule() schedule {
+	return schedule{time.Duration(s.Interval), time.Duration(s.Jitter), s.Align}
+}
+
+// validate checks the schedule of the loop name.
+func (s ScheduleConfig) validate(name string) error {
+	if s.Interval.seconds() < 1 {
+		return fmt.Errorf("intervals.%s must be at least 1s", name)
+	}
+	if s.Jitter < 0 || s.Jitter >= s.Interval {
+		return fmt.Errorf("intervals.%s: the jitter must be shorter than the interval", name)
+	}
+	return nil
+}
+
+type ListenConfig struct {
+	Addr string `json:"addr"`
+	// Mode is tsnet (listen in the tailnet) or regular.
+	Mode     string `json:"mode"`
+	Hostname string `json:"hostname"`
+}
+
+type LabelsConfig struct {
+	// Drop are the traffic labels that are not exported, their traffic
+	// is added up.
+	Drop []string `json:"drop"`
+	// DstPort and SrcPort add the dst_port and src_port labels. Only the
+	// Ports get a value of their own, the rest are other or ephemeral.
+	DstPort bool     `json:"dst_port"`
+	SrcPort bool     `json:"src_port"`
+	Ports   []uint16 `json:"ports"`
+	// Service adds the service label, the name of the service of the
+	// dst or src port. Services adds to (or renames) the known ones.
+	Service  bool              `json:"service"`
+	Services map[uint16]string `json:"services"`
+	// Reporter adds the reporter label, the node that logged the
+	// traffic: the router of subnet traffic, the exit node of exit
+	// traffic.
+	Reporter bool `json:"reporter"`
+}
+
+type LimitsConfig struct {
+	// MaxSeries is the series budget of every traffic metric, 0 for no
+	// limit. The series with the least traffic over it are folded into
+	// other.
+	MaxSeries int `json:"max_series"`
+}
+
+type NamesConfig struct {
+	// Strategy is ip (no names), short (shortest unique prefix of the
+	// device name) or full (the whole MagicDNS name).
+	Strategy string `json:"strategy"`
+}
+
+type SinksConfig struct {
+	Prometheus PrometheusSinkConfig `json:"prometheus"`
+	Textfile   TextfileSinkConfig   `json:"textfile"`
+}
+
+type PrometheusSinkConfig struct {
+	Path string `json:"path"`
+}
+
+// TextfileSinkConfig writes the metrics to Path every Interval, for the
+// node_exporter textfile collector. An empty path disables it.
+type TextfileSinkConfig struct {
+	Path     string   `json:"path"`
+	Interval duration `json:"interval"`
+}
+
+// Values of the listen mode and the name resolution strategy.
+const (
+	listenTsnet   = "tsnet"
+	listenRegular = "regular"
+
+	namesIP    = "ip"
+	namesShort = "short"
+	namesFull  = "full"
+)
+
+// duration is a time.Duration that reads from a string like "45s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"45s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) seconds() int {
+	return int(time.Duration(d) / time.Second)
+}
+
+var configReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsmetrics_config_reloads_total",
+	Help: "Config file reloads by result (success, failure)",
+}, []string{"result"})
+
+// flagConfig returns the config given by the flags and the env vars.
+func flagConfig() Config {
+	mode := listenTsnet
+	if *regularServer {
+		mode = listenRegular
+	}
+	strategy := namesIP
+	if *resolveNames {
+		strategy = namesShort
+	}
+	loop := func(secs int) ScheduleConfig {
+		return ScheduleConfig{
+			Interval: duration(time.Duration(secs) * time.Second),
+			Jitter:   duration(time.Duration(*jitterSecs) * time.Second),
+			Align:    *alignPolls,
+		}
+	}
+	devicesSecs := cmp.Or(*devicesWaitSecs, *waitTimeSecs)
+	return Config{
+		Tailnet: os.Getenv("TAILNET_NAME"),
+		Credentials: CredentialsConfig{
+			ClientID:     os.Getenv("OAUTH_CLIENT_ID"),
+			ClientSecret: os.Getenv("OAUTH_CLIENT_SECRET"),
+		},
+		Intervals: IntervalsConfig{
+			LoopIntervalsConfig: LoopIntervalsConfig{
+				Logs:    loop(*waitTimeSecs),
+				Devices: loop(devicesSecs),
+				Names:   loop(cmp.Or(*namesWaitSecs, devicesSecs)),
+			},
+			Checkpoint: duration(time.Duration(*checkpointSecs) * time.Second),
+		},
+		Listen: ListenConfig{Addr: *addr, Mode: mode, Hostname: *hostname},
+		Labels: LabelsConfig{
+			DstPort:  *dstPortLabel,
+			SrcPort:  *srcPortLabel,
+			Ports:    slices.Clone(*allowedPorts),
+			Service:  *serviceLabelFlag,
+			Reporter: *reporterLabel,
+		},
+		Names:  NamesConfig{Strategy: strategy},
+		Limits: LimitsConfig{MaxSeries: *maxSeries},
+		Sinks: SinksConfig{
+			Prometheus: PrometheusSinkConfig{Path: "/metrics"},
+			Textfile:   TextfileSinkConfig{Interval: duration(time.Minute)},
+		},
+	}
+}
+
+// loadConfig reads the config file at path on top of base and validates
+// it.
+func loadConfig(path string, base Config) (Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	b, err = hujson.Standardize(b)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	cfg := base
+	// The slices would be appended to
+	cfg.Tailnets = nil
+	cfg.TrafficTypes = nil
+	cfg.Labels.Drop = nil
+	cfg.Labels.Ports = slices.Clone(base.Labels.Ports)
+	cfg.Labels.Services = maps.Clone(base.Labels.Services)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	// A secret file given in the config wins over the env var
+	if cfg.Credentials.ClientIDFile != "" && cfg.Credentials.ClientID == base.Credentials.ClientID {
+		cfg.Credentials.ClientID = ""
+	}
+	if cfg.Credentials.ClientSecretFile != "" && cfg.Credentials.ClientSecret == base.Credentials.ClientSecret {
+		cfg.Credentials.ClientSecret = ""
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validate returns all the problems of the config at once.
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	seen := map[string]bool{}
+	for i, tc := range c.tailnets() {
+		// The problems of a listed tailnet say which one
+		prefix := ""
+		if len(c.Tailnets) > 0 {
+			prefix = fmt.Sprintf("tailnets[%d]: ", i)
+			check(tc.Name != "", "%sname is required", prefix)
+			check(!seen[tc.Name], "%stailnet %q is listed twice", prefix, tc.Name)
+			seen[tc.Name] = true
+		} else {
+			check(tc.Name != "", "tailnet is required (or TAILNET_NAME)")
+		}
+		_, _, err := tc.Credentials.read()
+		for _, err := range []error{
+			err,
+			tc.Intervals.Logs.validate(logsLoop),
+			tc.Intervals.Devices.validate(devicesLoop),
+			tc.Intervals.Names.validate(namesLoop),
+		} {
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s%w", prefix, err))
+			}
+		}
+	}
+	check(c.Intervals.Checkpoint.seconds() >= 1, "intervals.checkpoint must be at least 1s")
+	check(c.Listen.Addr != "", "listen.addr is required")
+	check(c.Listen.Mode == listenTsnet || c.Listen.Mode == listenRegular,
+		"listen.mode must be %s or %s, got %q", listenTsnet, listenRegular, c.Listen.Mode)
+	check(c.Listen.Mode != listenTsnet || c.Listen.Hostname != "", "listen.hostname is required in tsnet mode")
+	for _, l := range c.Labels.Drop {
+		check(slices.Contains(trafficLabels, l), "labels.drop: unknown label %q (one of %s)", l, strings.Join(trafficLabels, ", "))
+	}
+	check(!slices.Contains(c.Labels.Ports, 0), "labels.ports: 0 is not a port")
+	check(!c.Labels.Service || c.Labels.DstPort || c.Labels.SrcPort, "labels.service needs dst_port or src_port")
+	for port, name := range c.Labels.Services {
+		check(port != 0 && name != "", "labels.services: %d: %q is not a port and a name", port, name)
+	}
+	check(c.Limits.MaxSeries >= 0, "limits.max_series must not be negative")
+	check(slices.Contains([]string{namesIP, namesShort, namesFull}, c.Names.Strategy),
+		"names.strategy must be %s, %s or %s, got %q", namesIP, namesShort, namesFull, c.Names.Strategy)
+	for _, tt := range c.TrafficTypes {
+		_, ok := parseTrafficType(tt)
+		check(ok, "traffic_types: unknown traffic type %q", tt)
+	}
+	check(strings.HasPrefix(c.Sinks.Prometheus.Path, "/"), "sinks.prometheus.path must start with /")
+	check(c.Sinks.Textfile.Path == "" || c.Sinks.Textfile.Interval.seconds() >= 1,
+		"sinks.textfile.interval must be at least 1s")
+	return errors.Join(errs...)
+}
+
+// read returns the client id and secret, reading the files if set.
+func (c *CredentialsConfig) read() (string, string, error) {
+	value := func(name, v, file string) (string, error) {
+		if v != "" && file != "" {
+			return "", fmt.Errorf("credentials: set %s or %s_file, not both", name, name)
+		}
+		if file != "" {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return "", fmt.Errorf("credentials: %w", err)
+			}
+			v = strings.TrimSpace(string(b))
+		}
+		if v == "" {
+			return "", fmt.Errorf("credentials: %s is required (or OAUTH_%s)", name, strings.ToUpper(name))
+		}
+		return v, nil
+	}
+	id, err := value("client_id", c.ClientID, c.ClientIDFile)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := value("client_secret", c.ClientSecret, c.ClientSecretFile)
+	return id, secret, err
+}
+
+// tailnets returns the tailnets to collect with the top-level credentials
+// and schedules filled in.
+func (c *Config) tailnets() []TailnetConfig {
+	if len(c.Tailnets) == 0 {
+		return []TailnetConfig{{
+			Name:        c.Tailnet,
+			Credentials: c.Credentials,
+			Intervals:   c.Intervals.LoopIntervalsConfig,
+		}}
+	}
+	tcs := make([]TailnetConfig, len(c.Tailnets))
+	for i, tc := range c.Tailnets {
+		if tc.Credentials == (CredentialsConfig{}) {
+			tc.Credentials = c.Credentials
+		}
+		if tc.Intervals.Logs.Interval == 0 {
+			tc.Intervals.Logs = c.Intervals.Logs
+		}
+		if tc.Intervals.Devices.Interval == 0 {
+			tc.Intervals.Devices = c.Intervals.Devices
+		}
+		if tc.Intervals.Names.Interval == 0 {
+			tc.Intervals.Names = c.Intervals.Names
+		}
+		tcs[i] = tc
+	}
+	return tcs
+}
+
+// skippedTrafficTypes returns which traffic types are not aggregated.
+func (c *Config) skippedTrafficTypes() [4]bool {
+	var skip [4]bool
+	if len(c.TrafficTypes) == 0 {
+		return skip
+	}
+	for tt := range skip {
+		skip[tt] = true
+	}
+	for _, s := range c.TrafficTypes {
+		if tt, ok := parseTrafficType(s); ok {
+			skip[tt] = false
+		}
+	}
+	return skip
+}
+
+// restartOnly are the settings only read at startup, by name. They change
+// what is served or the labels of the series, a reload ignores them. So
+// does adding or removing tailnets, see exporter.applyConfig.
+func (c *Config) restartOnly() map[string]any {
+	return map[string]any{
+		"listen":           c.Listen,
+		"labels":           c.Labels,
+		"sinks.prometheus": c.Sinks.Prometheus,
+	}
+}
+
+// applyConfig sets the settings that can change while running to every
+// tailnet in cfg we collect. The tailnets cfg does not have keep their
+// settings, those cfg adds are not collected until a restart.
+func (e *exporter) applyConfig(cfg Config) error {
+	tcs := cfg.tailnets()
+	for _, a := range e.Tailnets {
+		i := slices.IndexFunc(tcs, func(tc TailnetConfig) bool { return tc.Name == a.TailNetName })
+		if i < 0 {
+			continue
+		}
+		if err := a.applyConfig(tcs[i], cfg); err != nil {
+			return fmt.Errorf("tailnet %s: %w", a.TailNetName, err)
+		}
+	}
+
+	e.cfgMu.Lock()
+	e.CheckpointIntervalSeconds = cfg.Intervals.Checkpoint.seconds()
+	e.TextfilePath = cfg.Sinks.Textfile.Path
+	e.TextfileIntervalSeconds = cfg.Sinks.Textfile.Interval.seconds()
+	e.config = cfg
+	e.cfgMu.Unlock()
+	return nil
+}
+
+// applyConfig sets the settings of the tailnet tc. They are written with
+// cfgMu held, the log poll takes the ones of the aggregation at its start.
+func (a *AppConfig) applyConfig(tc TailnetConfig, cfg Config) error {
+	id, secret, err := tc.Credentials.read()
+	if err != nil {
+		return err
+	}
+
+	a.cfgMu.Lock()
+	a.ClientId = id
+	a.ClientSecret = secret
+	a.Schedules = map[string]schedule{
+		logsLoop:    tc.Intervals.Logs.schedule(),
+		devicesLoop: tc.Intervals.Devices.schedule(),
+		namesLoop:   tc.Intervals.Names.schedule(),
+	}
+	a.ResolveNames = cfg.Names.Strategy != namesIP
+	a.logSettings = logSettings{
+		SkipTypes: cfg.skippedTrafficTypes(),
+		Ports:     newPortLabeler(cfg.Labels),
+		Reporter:  cfg.Labels.Reporter,
+	}
+	a.cfgMu.Unlock()
+
+	a.Names.SetFullNames(cfg.Names.Strategy == namesFull)
+	if cfg.Names.Strategy == namesIP {
+		a.Names.Clear()
+	}
+	if a.Traffic != nil {
+		a.recordFolded(a.Traffic.SetMaxSeries(cfg.Limits.MaxSeries))
+	}
+	for loop, s := range a.Schedules {
+		a.Health.SetInterval(a.subsystem(loop), s.period())
+		recordSchedule(a.TailNetName, loop, s)
+	}
+	return nil
+}
+
+// tailnetNames returns the names of the tailnets we collect.
+func (e *exporter) tailnetNames() []string {
+	names := make([]string, len(e.Tailnets))
+	for i, a := range e.Tailnets {
+		names[i] = a.TailNetName
+	}
+	return names
+}
+
+// reloadConfig loads the config file again and applies the settings that
+// are safe to change while running. The series are kept, a config that
+// does not validate is not applied at all.
+func (e *exporter) reloadConfig() error {
+	cfg, err := loadConfig(e.ConfigFile, e.configBase)
+	if err == nil {
+		e.cfgMu.RLock()
+		old := e.config
+		e.cfgMu.RUnlock()
+		var names []string
+		for _, tc := range cfg.tailnets() {
+			names = append(names, tc.Name)
+		}
+		if !slices.Equal(names, e.tailnetNames()) {
+			log.Printf("config: the tailnets changed, adding or removing one needs a restart to apply")
+		}
+		current := old.restartOnly()
+		for name, v := range cfg.restartOnly() {
+			if !reflect.DeepEqual(v, current[name]) {
+				log.Printf("config: %s changed, it needs a restart to apply", name)
+			}
+		}
+		if len(cfg.Tailnets) == 0 && len(old.Tailnets) == 0 {
+			// The only tailnet keeps its new settings
+			cfg.Tailnet = old.Tailnet
+		}
+		cfg.Listen = old.Listen
+		cfg.Labels = old.Labels
+		cfg.Sinks.Prometheus = old.Sinks.Prometheus
+		err = e.applyConfig(cfg)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("failure").Inc()
+		return err
+	}
+	configReloads.WithLabelValues("success").Inc()
+	log.Printf("config: reloaded %s", e.ConfigFile)
+	return nil
+}
+
+// configPollInterval is how often the config file is checked for changes.
+var configPollInterval = 5 * time.Second
+
+// watchConfigLoop reloads the config file on SIGHUP and when its
+// modification time or size changes.
+func (e *exporter) watchConfigLoop(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(e.ConfigFile)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+	mtime, size := stat()
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Printf("config: SIGHUP, reloading %s", e.ConfigFile)
+		case <-t.C:
+			m, s := stat()
+			// A missing file is not a change, it may be being replaced
+			if s < 0 || (m.Equal(mtime) && s == size) {
+				continue
+			}
+			log.Printf("config: %s changed, reloading", e.ConfigFile)
+		}
+		mtime, size = stat()
+		if err := e.reloadConfig(); err != nil {
+			log.Printf("config: keeping the previous config: %s", err)
+		}
+	}
+}
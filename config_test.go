@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testConfig is the config of the flag defaults plus what the env vars
+// would give.
+func testConfig() Config {
+	cfg := flagConfig()
+	cfg.Tailnet = "example.com"
+	cfg.Credentials = CredentialsConfig{ClientID: "id", ClientSecret: "secret"}
+	return cfg
+}
+
+func writeConfig(c *qt.C, path, s string) {
+	c.Assert(os.WriteFile(path, []byte(s), 0o600), qt.IsNil)
+}
+
+// writeConfigAt replaces the file at path with one modified at mtime, so
+// a watcher never sees it with another time.
+func writeConfigAt(c *qt.C, path, s string, mtime time.Time) {
+	tmp := path + ".tmp"
+	writeConfig(c, tmp, s)
+	c.Assert(os.Chtimes(tmp, mtime, mtime), qt.IsNil)
+	c.Assert(os.Rename(tmp, path), qt.IsNil)
+}
+
+func TestLoadConfig(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret")
+	c.Assert(os.WriteFile(secret, []byte("file-secret\n"), 0o600), qt.IsNil)
+	path := filepath.Join(dir, "tsmetrics.hujson")
+	writeConfig(c, path, `{
+		// Comments and trailing commas are fine
+		"tailnet": "other.com",
+		"credentials": {"client_secret_file": "`+secret+`"},
+		"intervals": {"logs": "2m", "devices": "10m"},
+		"listen": {"addr": ":9200", "mode": "regular"},
+		"labels": {"drop": ["proto"], "dst_port": true, "ports": [22, 443], "service": true, "services": {"9999": "myapp"}},
+		"names": {"strategy": "full"},
+		"traffic_types": ["virtual", "subnet"],
+		"sinks": {"textfile": {"path": "/tmp/tsmetrics.prom"}},
+	}`)
+
+	cfg, err := loadConfig(path, testConfig())
+	c.Assert(err, qt.IsNil)
+	c.Assert(cfg.Tailnet, qt.Equals, "other.com")
+	id, s, err := cfg.Credentials.read()
+	c.Assert(err, qt.IsNil)
+	c.Assert(id, qt.Equals, "id")
+	c.Assert(s, qt.Equals, "file-secret")
+	c.Assert(cfg.Intervals.Logs.schedule(), qt.Equals, schedule{Interval: 2 * time.Minute})
+	c.Assert(cfg.Intervals.Devices.schedule(), qt.Equals, schedule{Interval: 10 * time.Minute})
+	// The flag default
+	c.Assert(cfg.Intervals.Names.schedule(), qt.Equals, schedule{Interval: 45 * time.Second})
+	// Missing from the file, the flag default
+	c.Assert(cfg.Intervals.Checkpoint.seconds(), qt.Equals, 60)
+	c.Assert(cfg.Listen, qt.Equals, ListenConfig{Addr: ":9200", Mode: listenRegular, Hostname: "metrics"})
+	c.Assert(cfg.Labels.Drop, qt.DeepEquals, []string{"proto"})
+	c.Assert(cfg.Labels.DstPort, qt.IsTrue)
+	c.Assert(cfg.Labels.Ports, qt.DeepEquals, []uint16{22, 443})
+	c.Assert(cfg.Labels.services()[9999], qt.Equals, "myapp")
+	c.Assert(cfg.Labels.services()[22], qt.Equals, "ssh")
+	c.Assert(cfg.Names.Strategy, qt.Equals, namesFull)
+	c.Assert(cfg.skippedTrafficTypes(), qt.Equals, [4]bool{ExitTraffic: true, PhysicalTraffic: true})
+	c.Assert(cfg.Sinks.Prometheus.Path, qt.Equals, "/metrics")
+	c.Assert(cfg.Sinks.Textfile, qt.Equals, TextfileSinkConfig{"/tmp/tsmetrics.prom", duration(time.Minute)})
+
+	writeConfig(c, path, `{"intervals": {"logs": 45}}`)
+	_, err = loadConfig(path, testConfig())
+	c.Assert(err, qt.ErrorMatches, `.*duration must be a string.*`)
+
+	writeConfig(c, path, `{"tailnet": "a", "nope": 1}`)
+	_, err = loadConfig(path, testConfig())
+	c.Assert(err, qt.ErrorMatches, `.*unknown field "nope"`)
+}
+
+func TestConfigValidate(t *testing.T) {
+	c := qt.New(t)
+	cfg := testConfig()
+	c.Assert(cfg.validate(), qt.IsNil)
+
+	cfg.Tailnet = ""
+	cfg.Credentials.ClientSecretFile = "/nope"
+	cfg.Intervals.Logs.Interval = duration(time.Millisecond)
+	cfg.Intervals.Devices.Jitter = cfg.Intervals.Devices.Interval
+	cfg.Listen.Mode = "udp"
+	cfg.Labels.Drop = []string{"port"}
+	cfg.Labels.Service = true
+	cfg.Names.Strategy = "dns"
+	cfg.Limits.MaxSeries = -1
+	cfg.TrafficTypes = []string{"virtual", "wormhole"}
+	cfg.Sinks.Prometheus.Path = "metrics"
+	// All the problems are reported at once
+	c.Assert(cfg.validate(), qt.ErrorMatches, `tailnet is required.*
+credentials: set client_secret or client_secret_file, not both
+intervals.logs must be at least 1s
+intervals.devices: the jitter must be shorter than the interval
+listen.mode must be tsnet or regular, got "udp"
+labels.drop: unknown label "port".*
+labels.service needs dst_port or src_port
+limits.max_series must not be negative
+names.strategy must be ip, short or full, got "dns"
+traffic_types: unknown traffic type "wormhole"
+sinks.prometheus.path must start with /`)
+
+	cfg = testConfig()
+	cfg.Credentials.ClientID = ""
+	c.Assert(cfg.validate(), qt.ErrorMatches, `credentials: client_id is required \(or OAUTH_CLIENT_ID\)`)
+}
+
+func TestConfigTailnets(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "tsmetrics.hujson")
+	writeConfig(c, path, `{
+		"intervals": {"logs": "2m"},
+		"tailnets": [
+			{"name": "prod.com"},
+			{
+				"name": "staging.com",
+				"credentials": {"client_id": "staging-id", "client_secret": "staging-secret"},
+				"intervals": {"devices": "10m"},
+			},
+		],
+	}`)
+	cfg, err := loadConfig(path, testConfig())
+	c.Assert(err, qt.IsNil)
+	tcs := cfg.tailnets()
+	c.Assert(tcs, qt.HasLen, 2)
+	// The top-level credentials and schedules fill in the missing ones
+	c.Assert(tcs[0].Name, qt.Equals, "prod.com")
+	c.Assert(tcs[0].Credentials, qt.Equals, cfg.Credentials)
+	c.Assert(tcs[0].Intervals, qt.Equals, cfg.Intervals.LoopIntervalsConfig)
+	c.Assert(tcs[1].Credentials.ClientID, qt.Equals, "staging-id")
+	c.Assert(tcs[1].Intervals.Logs.schedule(), qt.Equals, schedule{Interval: 2 * time.Minute})
+	c.Assert(tcs[1].Intervals.Devices.schedule(), qt.Equals, schedule{Interval: 10 * time.Minute})
+
+	e := newConfigTestExporter(c, path, "prod.com", "staging.com")
+	c.Assert(e.Tailnets[0].ClientId, qt.Equals, "id")
+	c.Assert(e.Tailnets[1].ClientId, qt.Equals, "staging-id")
+	c.Assert(e.Tailnets[1].schedule(devicesLoop).Interval, qt.Equals, 10*time.Minute)
+
+	// Removing a tailnet needs a restart, it keeps its settings
+	writeConfig(c, path, `{"tailnets": [{"name": "staging.com", "intervals": {"devices": "20m"}}]}`)
+	c.Assert(e.reloadConfig(), qt.IsNil)
+	c.Assert(e.Tailnets[0].schedule(logsLoop).Interval, qt.Equals, 2*time.Minute)
+	c.Assert(e.Tailnets[1].ClientId, qt.Equals, "id")
+	c.Assert(e.Tailnets[1].schedule(devicesLoop).Interval, qt.Equals, 20*time.Minute)
+
+	cfg = testConfig()
+	cfg.Tailnets = []TailnetConfig{
+		{Name: "a.com"},
+		{Name: "a.com", Credentials: CredentialsConfig{ClientID: "id"}},
+		{Credentials: CredentialsConfig{ClientID: "id", ClientSecret: "secret"}},
+	}
+	cfg.Tailnets[0].Intervals.Names.Interval = duration(time.Millisecond)
+	c.Assert(cfg.validate(), qt.ErrorMatches, `tailnets\[0\]: intervals.names must be at least 1s
+tailnets\[1\]: tailnet "a.com" is listed twice
+tailnets\[1\]: credentials: client_secret is required \(or OAUTH_CLIENT_SECRET\)
+tailnets\[2\]: name is required`)
+}
+
+// newConfigTestExporter returns an exporter running the config file at
+// path, with a tailnet for each name.
+func newConfigTestExporter(c *qt.C, path string, names ...string) *exporter {
+	e := &exporter{Health: newHealthTracker(3), ConfigFile: path, configBase: testConfig()}
+	for _, name := range names {
+		a := newTestApp().AppConfig
+		a.TailNetName = name
+		a.Health = e.Health
+		a.Health.Expect(a.subsystem(logsLoop), 0)
+		a.Health.Expect(a.subsystem(devicesLoop), 0)
+		e.Tailnets = append(e.Tailnets, a)
+	}
+	cfg, err := loadConfig(path, e.configBase)
+	c.Assert(err, qt.IsNil)
+	c.Assert(e.applyConfig(cfg), qt.IsNil)
+	return e
+}
+
+func TestReloadConfig(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "tsmetrics.hujson")
+	writeConfig(c, path, `{"intervals": {"logs": "1m"}, "names": {"strategy": "short"}}`)
+	e := newConfigTestExporter(c, path, "example.com")
+	a := e.Tailnets[0]
+	c.Assert(a.schedule(logsLoop), qt.Equals, schedule{Interval: time.Minute})
+	c.Assert(a.ResolveNames, qt.IsTrue)
+
+	a.Traffic.Add(MapLogEntryToValue{
+		{netip.MustParseAddr("100.1.1.1"), netip.MustParseAddr("100.2.2.2"), VirtualTraffic, 6, 0, 0, 0, ""}: {TxBytes: 10},
+	}, nil, nil)
+	e.Health.Record(a.subsystem(logsLoop), nil)
+	successes := testutil.ToFloat64(configReloads.WithLabelValues("success"))
+	failures := testutil.ToFloat64(configReloads.WithLabelValues("failure"))
+
+	writeConfig(c, path, `{
+		"tailnet": "other.com",
+		"credentials": {"client_id": "new-id", "client_secret": "new-secret"},
+		"intervals": {
+			"logs": "2m",
+			"devices": {"interval": "5m", "jitter": "30s", "align": true},
+		},
+		"traffic_types": ["virtual"],
+		"limits": {"max_series": 1},
+	}`)
+	c.Assert(e.reloadConfig(), qt.IsNil)
+	c.Assert(testutil.ToFloat64(configReloads.WithLabelValues("success")), qt.Equals, successes+1)
+	c.Assert(a.ClientId, qt.Equals, "new-id")
+	c.Assert(a.ClientSecret, qt.Equals, "new-secret")
+	c.Assert(a.schedule(logsLoop), qt.Equals, schedule{Interval: 2 * time.Minute})
+	c.Assert(a.schedule(devicesLoop), qt.Equals, schedule{5 * time.Minute, 30 * time.Second, true})
+	c.Assert(testutil.ToFloat64(scheduleInterval.WithLabelValues("example.com", devicesLoop)), qt.Equals, 300.0)
+	c.Assert(testutil.ToFloat64(scheduleJitter.WithLabelValues("example.com", devicesLoop)), qt.Equals, 30.0)
+	c.Assert(testutil.ToFloat64(scheduleAligned.WithLabelValues("example.com", devicesLoop)), qt.Equals, 1.0)
+	c.Assert(a.logSettings.SkipTypes, qt.Equals, [4]bool{false, true, true, true})
+	// Back to the flag default
+	c.Assert(a.ResolveNames, qt.IsFalse)
+	// The tailnet needs a restart
+	c.Assert(e.config.Tailnet, qt.Equals, "example.com")
+	// Nothing was lost
+	c.Assert(a.Traffic.series, qt.HasLen, 1)
+	c.Assert(a.Traffic.maxSeries, qt.Equals, 1)
+	resp, ready := e.Health.check()
+	c.Assert(resp.Subsystems[a.subsystem(logsLoop)].LastSuccess.IsZero(), qt.IsFalse)
+	c.Assert(resp.Subsystems[a.subsystem(logsLoop)].interval, qt.Equals, 2*time.Minute)
+	c.Assert(ready, qt.IsFalse)
+
+	// A broken config is not applied
+	writeConfig(c, path, `{"intervals": {"logs": "1s"}, "names": {"strategy": "dns"}}`)
+	c.Assert(e.reloadConfig(), qt.ErrorMatches, `.*names.strategy.*`)
+	c.Assert(testutil.ToFloat64(configReloads.WithLabelValues("failure")), qt.Equals, failures+1)
+	c.Assert(a.schedule(logsLoop).Interval, qt.Equals, 2*time.Minute)
+}
+
+// blockingTransport holds every request until release is closed.
+type blockingTransport struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return nil, errors.New("released")
+}
+
+func TestReloadDuringPoll(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "tsmetrics.hujson")
+	writeConfig(c, path, `{"intervals": {"logs": "1m"}}`)
+	e := newConfigTestExporter(c, path, "example.com")
+	a := e.Tailnets[0]
+	transport := &blockingTransport{started: make(chan struct{}, 1), release: make(chan struct{})}
+	a.Transport = transport
+
+	done := make(chan error)
+	go func() { done <- a.pollLogs(context.Background()) }()
+	<-transport.started
+
+	// Neither the reload nor the checkpoint wait for the request
+	writeConfig(c, path, `{"intervals": {"logs": "2m"}}`)
+	reloaded := make(chan error)
+	go func() {
+		reloaded <- e.reloadConfig()
+		e.currentState()
+		close(reloaded)
+	}()
+	select {
+	case err := <-reloaded:
+		c.Assert(err, qt.IsNil)
+		<-reloaded
+	case <-time.After(5 * time.Second):
+		c.Fatal("the reload waited for the log poll")
+	}
+	c.Assert(a.schedule(logsLoop).Interval, qt.Equals, 2*time.Minute)
+	close(transport.release)
+	c.Assert(<-done, qt.Not(qt.IsNil))
+}
+
+func TestWatchConfigLoop(t *testing.T) {
+	c := qt.New(t)
+	c.Patch(&configPollInterval, 10*time.Millisecond)
+	path := filepath.Join(t.TempDir(), "tsmetrics.hujson")
+	writeConfig(c, path, `{"intervals": {"logs": "10s"}}`)
+	e := newConfigTestExporter(c, path, "example.com")
+	a := e.Tailnets[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.watchConfigLoop(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(secs int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for a.schedule(logsLoop).Interval != time.Duration(secs)*time.Second {
+			if time.Now().After(deadline) {
+				c.Fatalf("the interval is %s, want %ds", a.schedule(logsLoop).Interval, secs)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The file changes, once the loop has seen the first version
+	time.Sleep(50 * time.Millisecond)
+	writeConfig(c, path, `{"intervals": {"logs": "200s"}}`)
+	waitFor(200)
+
+	// Same size and modification time, only SIGHUP picks it up
+	fi, err := os.Stat(path)
+	c.Assert(err, qt.IsNil)
+	writeConfigAt(c, path, `{"intervals": {"logs": "300s"}}`, fi.ModTime())
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(a.schedule(logsLoop).Interval, qt.Equals, 200*time.Second)
+	p, err := os.FindProcess(os.Getpid())
+	c.Assert(err, qt.IsNil)
+	c.Assert(p.Signal(syscall.SIGHUP), qt.IsNil)
+	waitFor(300)
+}
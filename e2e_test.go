@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Devices of the end to end test.
+var jsonDevicesE2E = []byte(`{"devices": [
+	{"id": "e2e-1", "nodeId": "aBcdef1CNTRL", "hostname": "e2e-src", "name": "e2e-src.example.ts.net",
+	 "addresses": ["100.111.22.33"], "os": "linux", "user": "e2e@example.com",
+	 "authorized": true, "lastSeen": "2022-10-28T22:40:00Z", "expires": "0001-01-01T00:00:00Z"},
+	{"id": "e2e-2", "nodeId": "n2CNTRL", "hostname": "e2e-dst", "name": "e2e-dst.example.ts.net",
+	 "addresses": ["100.111.44.55"], "os": "macOS", "user": "e2e@example.com",
+	 "authorized": true, "lastSeen": "2022-10-28T22:40:00Z", "expires": "0001-01-01T00:00:00Z"}
+]}`)
+
+func TestEndToEnd(t *testing.T) {
+	c := qt.New(t)
+
+	fake := newFakeAPI(t, "e2e-tailnet", "e2e-id", "e2e-secret")
+	fake.SetDevices(jsonDevicesE2E)
+	var logs APILogResponse
+	c.Assert(json.Unmarshal(logOne, &logs), qt.IsNil)
+	now := time.Now()
+	fake.AddLogs(shiftLogs(logs.Logs, now.Add(-time.Second))...)
+
+	// The token and devices requests are retried by the transport. The
+	// truncated logs body is a decode error, the next poll gets them.
+	fake.Fail("token", fakeFailure{Status: http.StatusInternalServerError})
+	fake.Fail("devices", fakeFailure{Status: http.StatusTooManyRequests, RetryAfter: "0"})
+	fake.Fail("network-logs",
+		fakeFailure{Status: http.StatusServiceUnavailable},
+		fakeFailure{Truncate: true},
+	)
+	decodeErrors := testutil.ToFloat64(pollErrors.WithLabelValues(fake.Tailnet, logsLoop, decodeErrorKind))
+	devicesRetries := testutil.ToFloat64(apiRetries.WithLabelValues(fake.Tailnet, "devices"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := &exporter{
+		Health:                    newHealthTracker(3),
+		StateFile:                 filepath.Join(c.TempDir(), "state.json"),
+		CheckpointIntervalSeconds: 60,
+	}
+	a := newE2ETailnet(ctx, c, e, fake, now.Add(-time.Minute))
+	e.registerMetrics()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.run(ctx, ln)
+	}()
+	url := "http://" + ln.Addr().String()
+
+	metrics := scrapeUntil(c, url+"/metrics", []string{
+		`tailscale_tx_packets{dst="e2e-dst",proto="tcp",src="e2e-src",tailnet="e2e-tailnet",traffic_type="virtual"} 40`,
+		`tailscale_rx_packets{dst="e2e-dst",proto="tcp",src="e2e-src",tailnet="e2e-tailnet",traffic_type="virtual"} 22`,
+		`tailscale_hosts{client_version="",hostname="e2e-src",is_external="false",os="linux",tailnet="e2e-tailnet",update_available="false",user="e2e@example.com"} 1`,
+		`tailscale_device_authorized{hostname="e2e-dst",id="e2e-2",node_id="n2CNTRL",tailnet="e2e-tailnet"} 1`,
+		`tailscale_reporter_messages_total{node_id="aBcdef1CNTRL",reporter="e2e-src",tailnet="e2e-tailnet"} 1`,
+		`tailscale_reporter_messages_total{node_id="uvwXyz2CNTRL",reporter="uvwXyz2CNTRL",tailnet="e2e-tailnet"} 1`,
+		`tailscale_reporter_messages_total{node_id="n2CNTRL",reporter="e2e-dst",tailnet="e2e-tailnet"} 0`,
+	})
+	c.Assert(metrics, qt.Contains, `tsmetrics_last_success_timestamp_seconds{loop="logs",tailnet="e2e-tailnet"}`)
+	c.Assert(testutil.ToFloat64(pollErrors.WithLabelValues(fake.Tailnet, logsLoop, decodeErrorKind))-decodeErrors, qt.Equals, 1.0)
+	c.Assert(testutil.ToFloat64(apiRetries.WithLabelValues(fake.Tailnet, "devices"))-devicesRetries, qt.Equals, 1.0)
+
+	resp, err := http.Get(url + "/readyz")
+	c.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, qt.Equals, http.StatusOK)
+
+	// Every logs query covers the time since the cursor
+	reqs := fake.Requests("network-logs")
+	c.Assert(len(reqs) >= 3, qt.IsTrue)
+	for _, r := range reqs {
+		start, end, err := parseLogRange(r.URL.Query())
+		c.Assert(err, qt.IsNil)
+		c.Assert(start.Before(end), qt.IsTrue)
+		c.Assert(r.Header.Get("Authorization"), qt.Equals, "Bearer "+fakeAccessToken)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(15 * time.Second):
+		c.Fatal("run did not return after the shutdown")
+	}
+	s, err := loadState(e.StateFile)
+	c.Assert(err, qt.IsNil)
+	c.Assert(s.Tailnets[a.TailNetName].Cursor.Before(now.Add(-time.Second)), qt.IsFalse)
+}
+
+// Devices of the second tailnet of TestEndToEndTailnets, with the same
+// addresses as jsonDevicesE2E.
+var jsonDevicesE2EOther = []byte(`{"devices": [
+	{"id": "other-1", "hostname": "other-src", "name": "other-src.example.ts.net",
+	 "addresses": ["100.111.22.33"], "os": "linux", "user": "e2e@example.com",
+	 "authorized": true, "lastSeen": "2022-10-28T22:40:00Z", "expires": "0001-01-01T00:00:00Z"},
+	{"id": "other-2", "hostname": "other-dst", "name": "other-dst.example.ts.net",
+	 "addresses": ["100.111.44.55"], "os": "macOS", "user": "e2e@example.com",
+	 "authorized": false, "lastSeen": "2022-10-28T22:40:00Z", "expires": "0001-01-01T00:00:00Z"}
+]}`)
+
+func TestEndToEndTailnets(t *testing.T) {
+	c := qt.New(t)
+	var logs APILogResponse
+	c.Assert(json.Unmarshal(logOne, &logs), qt.IsNil)
+	now := time.Now()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := &exporter{Health: newHealthTracker(3)}
+	for _, tc := range []struct {
+		name    string
+		devices []byte
+	}{
+		{"e2e-tailnet", jsonDevicesE2E},
+		{"e2e-other", jsonDevicesE2EOther},
+	} {
+		fake := newFakeAPI(t, tc.name, tc.name+"-id", tc.name+"-secret")
+		fake.SetDevices(tc.devices)
+		fake.AddLogs(shiftLogs(logs.Logs, now.Add(-time.Second))...)
+		newE2ETailnet(ctx, c, e, fake, now.Add(-time.Minute))
+	}
+	e.registerMetrics()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.run(ctx, ln)
+	}()
+
+	// The same addresses have the names of their own tailnet
+	scrapeUntil(c, "http://"+ln.Addr().String()+"/metrics", []string{
+		`tailscale_tx_packets{dst="e2e-dst",proto="tcp",src="e2e-src",tailnet="e2e-tailnet",traffic_type="virtual"} 40`,
+		`tailscale_tx_packets{dst="other-dst",proto="tcp",src="other-src",tailnet="e2e-other",traffic_type="virtual"} 40`,
+		`tailscale_device_authorized{hostname="e2e-dst",id="e2e-2",node_id="n2CNTRL",tailnet="e2e-tailnet"} 1`,
+		`tailscale_device_authorized{hostname="other-dst",id="other-2",node_id="",tailnet="e2e-other"} 0`,
+	})
+
+	cancel()
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(15 * time.Second):
+		c.Fatal("run did not return after the shutdown")
+	}
+}
+
+// newE2ETailnet adds the tailnet of fake to e, polling every second from
+// cursor with the names resolved.
+func newE2ETailnet(ctx context.Context, c *qt.C, e *exporter, fake *fakeAPI, cursor time.Time) *AppConfig {
+	a := &AppConfig{
+		APIBaseURL: fake.APIURL(),
+		Transport: &retryTransport{
+			Tailnet:    fake.Tailnet,
+			Base:       http.DefaultTransport,
+			MaxRetries: 3,
+			BaseDelay:  time.Millisecond,
+			MaxDelay:   5 * time.Millisecond,
+			Timeout:    5 * time.Second,
+		},
+		TailNetName:  fake.Tailnet,
+		ClientId:     fake.ClientID,
+		ClientSecret: fake.ClientSecret,
+		Schedules:    map[string]schedule{logsLoop: {Interval: time.Second}},
+		LMData:       &LogMetricData{Tailnet: fake.Tailnet},
+		ResolveNames: true,
+		Names:        &nameResolver{Tailnet: fake.Tailnet},
+		Health:       e.Health,
+		Cursor:       cursor,
+	}
+	a.LMData.Init()
+	a.Health.Expect(a.subsystem(logsLoop), time.Second)
+	a.Health.Expect(a.subsystem(devicesLoop), time.Second)
+	c.Assert(a.Names.Resolve(ctx, a.apiBaseURL(), a.TailNetName, a.getOAuthClient(ctx)), qt.IsNil)
+	e.Tailnets = append(e.Tailnets, a)
+	return a
+}
+
+// scrapeUntil scrapes url until it has all the lines of want, for up to
+// 10s, and returns the last scrape.
+func scrapeUntil(c *qt.C, url string, want []string) string {
+	var metrics string
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		metrics = scrape(c, url)
+		if containsAll(metrics, want) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	for _, line := range want {
+		c.Assert(metrics, qt.Contains, line)
+	}
+	return metrics
+}
+
+func scrape(c *qt.C, url string) string {
+	resp, err := http.Get(url)
+	c.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	c.Assert(err, qt.IsNil)
+	return string(b)
+}
+
+func containsAll(s string, subs []string) bool {
+	for _, sub := range subs {
+		if !strings.Contains(s, sub) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"tailscale.com/tsnet"
+)
+
+// exporter collects the metrics of every tailnet concurrently and serves
+// them from one process, one tsnet node and one /metrics.
+type exporter struct {
+	Tailnets []*AppConfig
+	// Registry holds the metrics /metrics serves. The series of every
+	// tailnet carry its tailnet label.
+	Registry *prometheus.Registry
+	Health   *healthTracker
+	Server   *tsnet.Server
+	// MetricsPath is where the metrics are served, /metrics when empty
+	MetricsPath string
+	StateFile   string
+	// CheckpointIntervalSeconds is how often the state file is saved
+	CheckpointIntervalSeconds int
+	// TextfilePath is where the metrics are written every
+	// TextfileIntervalSeconds, empty disables it.
+	TextfilePath            string
+	TextfileIntervalSeconds int
+	// ConfigFile is reloaded on SIGHUP and when it changes. configBase is
+	// what it is read on top of and config the last one applied.
+	ConfigFile string
+	configBase Config
+	config     Config
+	// cfgMu guards the settings of the exporter a reload changes.
+	cfgMu sync.RWMutex
+}
+
+// registerMetrics creates the registry /metrics serves with the metrics of
+// every tailnet and the ones about tsmetrics itself.
+func (e *exporter) registerMetrics() {
+	e.Registry = prometheus.NewRegistry()
+	e.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	e.Registry.MustRegister(exporterMetrics()...)
+	for _, a := range e.Tailnets {
+		a.registerMetrics(e.Registry)
+	}
+}
+
+// tailnet returns the collector of the tailnet name, nil if there is
+// none.
+func (e *exporter) tailnet(name string) *AppConfig {
+	for _, a := range e.Tailnets {
+		if a.TailNetName == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// interval reads one of the interval settings in seconds, they can change
+// on a config reload.
+func (e *exporter) interval(secs *int) time.Duration {
+	e.cfgMu.RLock()
+	defer e.cfgMu.RUnlock()
+	return time.Duration(*secs) * time.Second
+}
+
+// run starts the collection loops and serves the metrics on ln until ctx
+// is done. Before returning it waits for the loops, flushes the pending log
+// data and saves the state.
+func (e *exporter) run(ctx context.Context, ln net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	loops := []func(context.Context){e.textfileLoop}
+	for _, a := range e.Tailnets {
+		loops = append(loops, a.loops()...)
+	}
+	if e.StateFile != "" {
+		loops = append(loops, e.checkpointStateLoop)
+	}
+	if e.ConfigFile != "" {
+		loops = append(loops, e.watchConfigLoop)
+	}
+	for _, loop := range loops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loop(ctx)
+		}()
+	}
+
+	srv := &http.Server{
+		Handler:     e.handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Printf("shutting down")
+	case err = <-serveErr:
+		cancel()
+	}
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down the http server: %s", err)
+	}
+	wg.Wait()
+
+	for _, a := range e.Tailnets {
+		a.stateMu.Lock()
+		a.consumeNewLogData()
+		a.stateMu.Unlock()
+	}
+	e.saveState()
+	return err
+}
+
+func (e *exporter) handler() http.Handler {
+	mux := http.NewServeMux()
+	path := e.MetricsPath
+	if path == "" {
+		path = "/metrics"
+	}
+	mux.Handle(path, promhttp.HandlerFor(e.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", e.Health.healthz)
+	mux.HandleFunc("/readyz", e.Health.readyz)
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
+	})
+	return mux
+}
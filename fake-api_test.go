@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFailure is an error the fake API returns instead of the real
+// response.
+type fakeFailure struct {
+	Status     int
+	RetryAfter string
+	// Truncate sends a 200 with half of the real body.
+	Truncate bool
+}
+
+// fakeAPI is a stand-in for the Tailscale control API good enough to run
+// the whole exporter against it: OAuth token exchange, devices and network
+// logs with start/end filtering. Failures can be queued per endpoint.
+type fakeAPI struct {
+	*httptest.Server
+
+	Tailnet      string
+	ClientID     string
+	ClientSecret string
+
+	mu       sync.Mutex
+	devices  []byte
+	logs     []Message
+	failures map[string][]fakeFailure
+	requests []*http.Request
+}
+
+const fakeAccessToken = "fake-access-token"
+
+func newFakeAPI(t *testing.T, tailnet, clientID, clientSecret string) *fakeAPI {
+	f := &fakeAPI{
+		Tailnet:      tailnet,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		devices:      []byte(`{"devices": []}`),
+		failures:     map[string][]fakeFailure{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/v2/oauth/token", f.token)
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/devices", f.authorized(f.serveDevices))
+	mux.HandleFunc("GET /api/v2/tailnet/{tailnet}/network-logs", f.authorized(f.serveLogs))
+	f.Server = httptest.NewServer(f.record(mux))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// URL of the API, what --api-url takes.
+func (f *fakeAPI) APIURL() string {
+	return f.Server.URL + "/api/v2"
+}
+
+func (f *fakeAPI) SetDevices(b []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.devices = b
+}
+
+func (f *fakeAPI) AddLogs(msgs ...Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.logs = append(f.logs, msgs...)
+}
+
+// Fail queues failures for the endpoint (token, devices, network-logs).
+// Each request to the endpoint consumes one, a zero fakeFailure lets the
+// request through.
+func (f *fakeAPI) Fail(endpoint string, failures ...fakeFailure) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[endpoint] = append(f.failures[endpoint], failures...)
+}
+
+// Requests returns the requests received for the endpoint.
+func (f *fakeAPI) Requests(endpoint string) []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var reqs []*http.Request
+	for _, r := range f.requests {
+		if strings.HasSuffix(r.URL.Path, "/"+endpoint) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs
+}
+
+func (f *fakeAPI) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.Clone(r.Context()))
+		f.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// nextFailure pops the next failure queued for the endpoint.
+func (f *fakeAPI) nextFailure(endpoint string) (fakeFailure, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q := f.failures[endpoint]
+	if len(q) == 0 {
+		return fakeFailure{}, false
+	}
+	f.failures[endpoint] = q[1:]
+	return q[0], true
+}
+
+// reply writes body unless a failure is queued for the endpoint. The body
+// is gzipped if the client asks for it.
+func (f *fakeAPI) reply(w http.ResponseWriter, r *http.Request, endpoint string, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if fail, ok := f.nextFailure(endpoint); ok && fail != (fakeFailure{}) {
+		if fail.Truncate {
+			w.Write(body[:len(body)/2])
+			return
+		}
+		w.Header().Del("Content-Encoding")
+		if fail.RetryAfter != "" {
+			w.Header().Set("Retry-After", fail.RetryAfter)
+		}
+		w.WriteHeader(fail.Status)
+		w.Write([]byte(`{"message": "injected failure"}`))
+		return
+	}
+	w.Write(body)
+}
+
+func (f *fakeAPI) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if id != f.ClientID || secret != f.ClientSecret {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	body, _ := json.Marshal(map[string]any{
+		"access_token": fakeAccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+	f.reply(w, r, "token", body)
+}
+
+func (f *fakeAPI) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeAccessToken {
+			http.Error(w, `{"message": "unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		if r.PathValue("tailnet") != f.Tailnet {
+			http.Error(w, `{"message": "tailnet not found"}`, http.StatusNotFound)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (f *fakeAPI) serveDevices(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	body := f.devices
+	f.mu.Unlock()
+	f.reply(w, r, "devices", body)
+}
+
+// serveLogs returns the messages logged within [start, end], like the
+// real API does.
+func (f *fakeAPI) serveLogs(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseLogRange(r.URL.Query())
+	if err != nil {
+		http.Error(w, `{"message": "`+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	resp := APILogResponse{Logs: []Message{}}
+	for _, msg := range f.logs {
+		if !msg.Logged.Before(start) && !msg.Logged.After(end) {
+			resp.Logs = append(resp.Logs, msg)
+		}
+	}
+	f.mu.Unlock()
+
+	body, _ := json.Marshal(resp)
+	f.reply(w, r, "network-logs", body)
+}
+
+func parseLogRange(q url.Values) (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339Nano, q.Get("start"))
+	if err != nil {
+		return start, start, err
+	}
+	end, err := time.Parse(time.RFC3339Nano, q.Get("end"))
+	return start, end, err
+}
+
+// shiftLogs moves the messages in time so the newest one is logged at to,
+// the fixtures are from 2022.
+func shiftLogs(msgs []Message, to time.Time) []Message {
+	var newest time.Time
+	for _, msg := range msgs {
+		if msg.Logged.After(newest) {
+			newest = msg.Logged
+		}
+	}
+	d := to.Sub(newest)
+	shifted := make([]Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Logged = msg.Logged.Add(d)
+		msg.Start = msg.Start.Add(d)
+		msg.End = msg.End.Add(d)
+		shifted[i] = msg
+	}
+	return shifted
+}
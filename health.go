@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// subsystemHealth is the state of one collection loop as reported by the
+// health endpoints.
+type subsystemHealth struct {
+	Status        string    `json:"status"`
+	LastSuccess   time.Time `json:"last_success,omitzero"`
+	LastError     string    `json:"last_error,omitempty"`
+	LastErrorTime time.Time `json:"last_error_time,omitzero"`
+
+	// Interval is how often the loop is expected to succeed.
+	interval time.Duration
+}
+
+type healthResponse struct {
+	Status     string                      `json:"status"`
+	Subsystems map[string]*subsystemHealth `json:"subsystems"`
+}
+
+// healthTracker keeps the outcome of the last polls of every loop so we
+// can tell if tsmetrics is actually producing data.
+type healthTracker struct {
+	// StaleFactor is how many intervals a loop can go without a
+	// successful poll before we stop being ready.
+	StaleFactor float64
+
+	mu         sync.Mutex
+	subsystems map[string]*subsystemHealth
+	now        func() time.Time
+}
+
+func newHealthTracker(staleFactor float64) *healthTracker {
+	return &healthTracker{
+		StaleFactor: staleFactor,
+		subsystems:  map[string]*subsystemHealth{},
+		now:         time.Now,
+	}
+}
+
+// Expect registers a loop that has to succeed every interval for us to be
+// ready.
+func (h *healthTracker) Expect(name string, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subsystems[name] = &subsystemHealth{interval: interval}
+}
+
+// SetInterval changes the interval of a loop, keeping its last outcome.
+func (h *healthTracker) SetInterval(name string, interval time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.subsystems[name]; ok {
+		s.interval = interval
+	}
+}
+
+// Record stores the outcome of a poll of the loop name.
+func (h *healthTracker) Record(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.subsystems[name]
+	if !ok {
+		return
+	}
+	if err != nil {
+		s.LastError = err.Error()
+		s.LastErrorTime = h.now()
+		return
+	}
+	s.LastSuccess = h.now()
+}
+
+// check returns the status of every loop and whether all of them are
+// ready.
+func (h *healthTracker) check() (healthResponse, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	ready := true
+	resp := healthResponse{Status: "ok", Subsystems: map[string]*subsystemHealth{}}
+	names := make([]string, 0, len(h.subsystems))
+	for name := range h.subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := *h.subsystems[name]
+		maxAge := time.Duration(h.StaleFactor * float64(s.interval))
+		switch {
+		case s.LastSuccess.IsZero():
+			s.Status = "starting"
+			ready = false
+		case now.Sub(s.LastSuccess) > maxAge:
+			s.Status = "stale"
+			ready = false
+		default:
+			s.Status = "ok"
+		}
+		resp.Subsystems[name] = &s
+	}
+	if !ready {
+		resp.Status = "unavailable"
+	}
+	return resp, ready
+}
+
+// healthz is the liveness endpoint. If we can answer we are alive, the
+// body still carries the status of every loop.
+func (h *healthTracker) healthz(w http.ResponseWriter, r *http.Request) {
+	resp, _ := h.check()
+	resp.Status = "ok"
+	writeHealth(w, http.StatusOK, resp)
+}
+
+// readyz is the readiness endpoint. It fails until every loop had a
+// successful poll and whenever one of them goes stale.
+func (h *healthTracker) readyz(w http.ResponseWriter, r *http.Request) {
+	resp, ready := h.check()
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, resp)
+}
+
+func writeHealth(w http.ResponseWriter, code int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func getHealth(t *testing.T, handler http.HandlerFunc) (int, healthResponse) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var resp healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding health response: %s", err)
+	}
+	return rec.Code, resp
+}
+
+func TestHealth(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2022, 10, 28, 22, 40, 0, 0, time.UTC)
+	h := newHealthTracker(3)
+	h.now = func() time.Time { return now }
+	h.Expect(logsLoop, time.Minute)
+	h.Expect(devicesLoop, time.Minute)
+
+	// Not ready until both loops succeeded once, but alive
+	code, resp := getHealth(t, h.readyz)
+	c.Assert(code, qt.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Subsystems[logsLoop].Status, qt.Equals, "starting")
+	code, resp = getHealth(t, h.healthz)
+	c.Assert(code, qt.Equals, http.StatusOK)
+	c.Assert(resp.Status, qt.Equals, "ok")
+
+	h.Record(logsLoop, nil)
+	h.Record(devicesLoop, errors.New("http: 401"))
+	code, resp = getHealth(t, h.readyz)
+	c.Assert(code, qt.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Subsystems[logsLoop].Status, qt.Equals, "ok")
+	c.Assert(resp.Subsystems[devicesLoop].LastError, qt.Equals, "http: 401")
+
+	h.Record(devicesLoop, nil)
+	code, resp = getHealth(t, h.readyz)
+	c.Assert(code, qt.Equals, http.StatusOK)
+	c.Assert(resp.Status, qt.Equals, "ok")
+
+	// The logs loop stops succeeding for longer than 3 intervals
+	now = now.Add(2 * time.Minute)
+	h.Record(devicesLoop, nil)
+	now = now.Add(2 * time.Minute)
+	h.Record(logsLoop, errors.New("http: 500"))
+	code, resp = getHealth(t, h.readyz)
+	c.Assert(code, qt.Equals, http.StatusServiceUnavailable)
+	c.Assert(resp.Status, qt.Equals, "unavailable")
+	c.Assert(resp.Subsystems[logsLoop].Status, qt.Equals, "stale")
+	c.Assert(resp.Subsystems[logsLoop].LastError, qt.Equals, "http: 500")
+	c.Assert(resp.Subsystems[devicesLoop].Status, qt.Equals, "ok")
+}
@@ -3,61 +3,221 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/netip"
 	"strings"
+	"sync/atomic"
 
-	"tailscale.com/util/must"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
-func mustMakeNamesByAddr(tailnetName *string, client LogClient) map[netip.Addr]string {
+// deviceName is what we need from a device to label its traffic.
+type deviceName struct {
+	Name  string       `json:"name"`
+	Addrs []netip.Addr `json:"addresses"`
+	// NodeID is the stable id of the device, the one in the network
+	// logs.
+	NodeID string `json:"nodeId"`
+}
+
+var namesResolved = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tsmetrics_names_resolved",
+	Help: "1 if the traffic is labeled with names from the last refresh, 0 if degraded (stale names or IP addresses)",
+}, []string{"tailnet"})
+
+// nameResolver maps Tailscale addresses to device names. Failing to
+// resolve is never fatal: we keep the last good mapping or, if we never
+// had one, the traffic is labeled with the IP addresses.
+type nameResolver struct {
+	// Tailnet is the tailnet label of tsmetrics_names_resolved. Every
+	// tailnet has its own resolver, the same address can be a different
+	// device in another tailnet.
+	Tailnet string
+	// namesByAddr is swapped as a whole on every refresh so readers never
+	// see a half built map.
+	namesByAddr atomic.Pointer[map[netip.Addr]string]
+	// namesByNode is the same names by the stable id of the device
+	namesByNode atomic.Pointer[map[string]string]
+	// labels is the label every device name got in the last refresh
+	labels map[string]string
+	// fullNames labels the devices with their whole name instead of the
+	// shortest unique prefix.
+	fullNames atomic.Bool
+}
+
+// SetFullNames picks between full names and short ones from the next
+// refresh on.
+func (r *nameResolver) SetFullNames(full bool) {
+	r.fullNames.Store(full)
+}
+
+// NamesByAddr returns the current mapping, nil if we do not have one.
+func (r *nameResolver) NamesByAddr() map[netip.Addr]string {
+	if m := r.namesByAddr.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// NamesByNode returns the names by node id, nil if we do not have them.
+func (r *nameResolver) NamesByNode() map[string]string {
+	if m := r.namesByNode.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// Clear drops the mapping, the traffic is labeled with the IP addresses.
+func (r *nameResolver) Clear() {
+	r.namesByAddr.Store(nil)
+	r.namesByNode.Store(nil)
+	namesResolved.WithLabelValues(r.Tailnet).Set(0)
+}
+
+// Update rebuilds the mapping from the devices and swaps it in. On error
+// the current mapping is kept.
+func (r *nameResolver) Update(devices []deviceName) error {
+	if r.fullNames.Load() {
+		// labels are kept for when we go back to short names
+		namesByAddr := makeFullNamesByAddr(devices)
+		namesByNode := makeNamesByNode(devices, func(d deviceName) string {
+			return strings.TrimSuffix(d.Name, ".")
+		})
+		r.namesByAddr.Store(&namesByAddr)
+		r.namesByNode.Store(&namesByNode)
+		namesResolved.WithLabelValues(r.Tailnet).Set(1)
+		return nil
+	}
+	namesByAddr, labels, err := makeNamesByAddr(devices, r.labels)
+	if err != nil {
+		namesResolved.WithLabelValues(r.Tailnet).Set(0)
+		return err
+	}
+	r.labels = labels
+	namesByNode := makeNamesByNode(devices, func(d deviceName) string { return labels[d.Name] })
+	r.namesByAddr.Store(&namesByAddr)
+	r.namesByNode.Store(&namesByNode)
+	namesResolved.WithLabelValues(r.Tailnet).Set(1)
+	return nil
+}
+
+// Resolve fetches the devices of the tailnet and updates the mapping.
+func (r *nameResolver) Resolve(ctx context.Context, apiURL, tailnetName string, client LogClient) error {
+	devices, err := getDeviceNames(ctx, apiURL, tailnetName, client)
+	if err != nil {
+		namesResolved.WithLabelValues(r.Tailnet).Set(0)
+		return err
+	}
+	return r.Update(devices)
+}
+
+func getDeviceNames(ctx context.Context, apiURL, tailnetName string, client LogClient) ([]deviceName, error) {
 	// Query the Tailscale API for a list of devices in the tailnet.
-	const apiURL = "https://api.tailscale.com/api/v2"
-	resp, err := client.Get(apiURL + "/tailnet/" + *tailnetName + "/devices")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL+"/tailnet/"+tailnetName+"/devices", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Fatalf("failing requesting tailnet devices for name to add mapping. err=%s", err)
+		return nil, transportError(fmt.Errorf("requesting tailnet devices for name to addr mapping: %w", err))
 	}
 	defer resp.Body.Close()
-	b := must.Get(io.ReadAll(resp.Body))
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, transportError(fmt.Errorf("reading tailnet devices: %w", err))
+	}
 	if resp.StatusCode != 200 {
-		log.Fatalf("http: %v: %s", http.StatusText(resp.StatusCode), b)
+		return nil, httpStatusError(resp.StatusCode, fmt.Errorf("http: %v: %s", http.StatusText(resp.StatusCode), b))
 	}
 
 	// Unmarshal the API response.
 	var m struct {
-		Devices []struct {
-			Name  string       `json:"name"`
-			Addrs []netip.Addr `json:"addresses"`
-		} `json:"devices"`
-	}
-	must.Do(json.Unmarshal(b, &m))
-
-	// Construct a unique mapping of Tailscale IP addresses to hostnames.
-	// For brevity, we start with the first segment of the name and
-	// use more segments until we find the shortest prefix that is unique
-	// for all names in the tailnet.
-	seen := make(map[string]bool)
-	namesByAddr := make(map[netip.Addr]string)
+		Devices []deviceName `json:"devices"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, decodeError(fmt.Errorf("decoding tailnet devices: %w", err))
+	}
+	return m.Devices, nil
+}
+
+// makeNamesByAddr constructs a unique mapping of Tailscale IP addresses to
+// hostnames. It also returns the label picked for every device name so
+// it can be passed as prev in the next refresh.
+//
+// For brevity, we start with the first segment of the name and use more
+// segments until we find the shortest prefix that is unique for all names
+// in the tailnet. Devices keep the label they had in prev as long as it is
+// still unique, so adding a device with a similar name does not change the
+// labels of the existing ones.
+func makeNamesByAddr(devices []deviceName, prev map[string]string) (map[netip.Addr]string, map[string]string, error) {
+	labels := make(map[string]string)
+	seen := make(map[string]int)
+	found := false
 retry:
-	for i := 0; i < 10; i++ {
+	// Start at 1: with a single device the empty prefix would be unique.
+	for i := 1; i < 10; i++ {
 		clear(seen)
-		clear(namesByAddr)
-		for _, d := range m.Devices {
+		clear(labels)
+		for _, d := range devices {
 			name := fieldPrefix(d.Name, i)
-			if seen[name] {
+			if seen[name] > 0 {
 				continue retry
 			}
-			seen[name] = true
-			for _, a := range d.Addrs {
-				namesByAddr[a] = name
-			}
+			seen[name]++
+			labels[d.Name] = name
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, nil, errors.New("unable to produce unique mapping of address to names")
+	}
+
+	for _, d := range devices {
+		p, ok := prev[d.Name]
+		if !ok || p == labels[d.Name] || seen[p] > 0 {
+			continue
+		}
+		seen[labels[d.Name]]--
+		seen[p]++
+		labels[d.Name] = p
+	}
+
+	namesByAddr := make(map[netip.Addr]string)
+	for _, d := range devices {
+		for _, a := range d.Addrs {
+			namesByAddr[a] = labels[d.Name]
+		}
+	}
+	return namesByAddr, labels, nil
+}
+
+// makeFullNamesByAddr maps Tailscale IP addresses to the whole device name,
+// which is unique in the tailnet.
+func makeFullNamesByAddr(devices []deviceName) map[netip.Addr]string {
+	namesByAddr := make(map[netip.Addr]string)
+	for _, d := range devices {
+		for _, a := range d.Addrs {
+			namesByAddr[a] = strings.TrimSuffix(d.Name, ".")
+		}
+	}
+	return namesByAddr
+}
+
+// makeNamesByNode maps the node id of every device to its label.
+func makeNamesByNode(devices []deviceName, label func(deviceName) string) map[string]string {
+	namesByNode := make(map[string]string)
+	for _, d := range devices {
+		if d.NodeID != "" {
+			namesByNode[d.NodeID] = label(d)
 		}
-		return namesByAddr
 	}
-	panic("unable to produce unique mapping of address to names")
+	return namesByNode
 }
 
 // fieldPrefix returns the first n number of dot-separated segments.
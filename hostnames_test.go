@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMakeNamesByAddrStable(t *testing.T) {
+	c := qt.New(t)
+	a := deviceName{"a.x.ts.net", []netip.Addr{netip.MustParseAddr("100.1.1.1")}, ""}
+	b := deviceName{"b.y.ts.net", []netip.Addr{netip.MustParseAddr("100.1.1.2")}, ""}
+	a2 := deviceName{"a.z.ts.net", []netip.Addr{netip.MustParseAddr("100.1.1.3")}, ""}
+
+	namesByAddr, labels, err := makeNamesByAddr([]deviceName{a, b}, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(namesByAddr[a.Addrs[0]], qt.Equals, "a")
+	c.Assert(namesByAddr[b.Addrs[0]], qt.Equals, "b")
+
+	// Without the previous labels a colliding newcomer renames everybody
+	namesByAddr, _, err = makeNamesByAddr([]deviceName{a, b, a2}, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(namesByAddr[a.Addrs[0]], qt.Equals, "a.x")
+
+	// With them the existing devices keep their labels
+	namesByAddr, labels, err = makeNamesByAddr([]deviceName{a, b, a2}, labels)
+	c.Assert(err, qt.IsNil)
+	c.Assert(namesByAddr[a.Addrs[0]], qt.Equals, "a")
+	c.Assert(namesByAddr[b.Addrs[0]], qt.Equals, "b")
+	c.Assert(namesByAddr[a2.Addrs[0]], qt.Equals, "a.z")
+
+	// A device that takes over a label in use does not get a duplicate
+	b.Name = "a.w.ts.net"
+	namesByAddr, _, err = makeNamesByAddr([]deviceName{a, b, a2}, labels)
+	c.Assert(err, qt.IsNil)
+	c.Assert(namesByAddr[a.Addrs[0]], qt.Equals, "a")
+	c.Assert(namesByAddr[b.Addrs[0]], qt.Equals, "a.w")
+	c.Assert(namesByAddr[a2.Addrs[0]], qt.Equals, "a.z")
+}
+
+func TestNameResolver(t *testing.T) {
+	c := qt.New(t)
+	r := &nameResolver{Tailnet: "dummy"}
+	c.Assert(r.NamesByAddr(), qt.IsNil)
+
+	addr := netip.MustParseAddr("100.1.1.1")
+	c.Assert(r.Update([]deviceName{{"old.ts.net", []netip.Addr{addr}, ""}}), qt.IsNil)
+	c.Assert(r.NamesByAddr()[addr], qt.Equals, "old")
+	c.Assert(testutil.ToFloat64(namesResolved.WithLabelValues("dummy")), qt.Equals, 1.0)
+
+	c.Assert(r.Update([]deviceName{{"new.ts.net", []netip.Addr{addr}, "n1"}}), qt.IsNil)
+	c.Assert(r.NamesByAddr()[addr], qt.Equals, "new")
+	c.Assert(r.NamesByNode(), qt.DeepEquals, map[string]string{"n1": "new"})
+
+	r.SetFullNames(true)
+	c.Assert(r.Update([]deviceName{{"new.ts.net.", []netip.Addr{addr}, "n1"}}), qt.IsNil)
+	c.Assert(r.NamesByAddr()[addr], qt.Equals, "new.ts.net")
+	c.Assert(r.NamesByNode(), qt.DeepEquals, map[string]string{"n1": "new.ts.net"})
+
+	r.Clear()
+	c.Assert(r.NamesByAddr(), qt.IsNil)
+	c.Assert(r.NamesByNode(), qt.IsNil)
+	c.Assert(testutil.ToFloat64(namesResolved.WithLabelValues("dummy")), qt.Equals, 0.0)
+}
+
+func TestNameResolverDegraded(t *testing.T) {
+	c := qt.New(t)
+	r := &nameResolver{Tailnet: "dummy"}
+
+	// The API fails before we ever resolved: no mapping, IP labels
+	failing := &FakeClientLog{}
+	failing.SetJson([]byte(`{"devices": [`))
+	err := r.Resolve(context.Background(), defaultAPIBaseURL, "dummy", failing)
+	c.Assert(errorKind(err), qt.Equals, decodeErrorKind)
+	c.Assert(r.NamesByAddr(), qt.IsNil)
+	c.Assert(testutil.ToFloat64(namesResolved.WithLabelValues("dummy")), qt.Equals, 0.0)
+
+	ok := &FakeClientLog{}
+	ok.SetJson(jsonDevicesTwo)
+	c.Assert(r.Resolve(context.Background(), defaultAPIBaseURL, "dummy", ok), qt.IsNil)
+	c.Assert(r.NamesByAddr()[netip.MustParseAddr("100.111.22.33")], qt.Equals, "hello")
+
+	// Later failures keep the last good mapping
+	c.Assert(r.Resolve(context.Background(), defaultAPIBaseURL, "dummy", failing), qt.Not(qt.IsNil))
+	c.Assert(r.NamesByAddr()[netip.MustParseAddr("100.111.22.33")], qt.Equals, "hello")
+	c.Assert(testutil.ToFloat64(namesResolved.WithLabelValues("dummy")), qt.Equals, 0.0)
+
+	// So do names we cannot make unique
+	same := []deviceName{
+		{"a.b.c.d.e.f.g.h.i.j.k", []netip.Addr{netip.MustParseAddr("100.1.1.1")}, ""},
+		{"a.b.c.d.e.f.g.h.i.j.k", []netip.Addr{netip.MustParseAddr("100.1.1.2")}, ""},
+	}
+	c.Assert(r.Update(same), qt.ErrorMatches, "unable to produce unique mapping.*")
+	c.Assert(r.NamesByAddr()[netip.MustParseAddr("100.111.22.33")], qt.Equals, "hello")
+}
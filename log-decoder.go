@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errResponseTooLarge = errors.New("response too large")
+
+// maxBytesReader fails with errResponseTooLarge once more than max bytes
+// are read from r.
+type maxBytesReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.n > m.max {
+		return 0, fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, m.max)
+	}
+	// Read one byte past the limit so we can tell a body of exactly max
+	// bytes from a larger one.
+	if left := m.max - m.n + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.max {
+		return n, fmt.Errorf("%w: more than %d bytes", errResponseTooLarge, m.max)
+	}
+	return n, err
+}
+
+// decodeLogs decodes a network-logs response from r and calls fn with every
+// message as soon as it is decoded, so the response is never held in memory
+// as a whole. The message is reused, fn must not keep it.
+func decodeLogs(r io.Reader, fn func(*Message)) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	var msg Message
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok != "logs" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		if tok == nil {
+			// "logs": null
+			continue
+		}
+		if tok != json.Delim('[') {
+			return fmt.Errorf("logs: expected an array, got %v", tok)
+		}
+		for dec.More() {
+			// Keep the capacity of the slices, the decoder appends to them.
+			msg = Message{
+				VirtualTraffic:  msg.VirtualTraffic[:0],
+				SubnetTraffic:   msg.SubnetTraffic[:0],
+				ExitTraffic:     msg.ExitTraffic[:0],
+				PhysicalTraffic: msg.PhysicalTraffic[:0],
+			}
+			if err := dec.Decode(&msg); err != nil {
+				return err
+			}
+			fn(&msg)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("expected %s, got %v", d, tok)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDecodeLogs(t *testing.T) {
+	c := qt.New(t)
+
+	var want APILogResponse
+	c.Assert(json.Unmarshal(logOne, &want), qt.IsNil)
+	var got []Message
+	err := decodeLogs(bytes.NewReader(logOne), func(msg *Message) {
+		got = append(got, *msg)
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.HasLen, len(want.Logs))
+	c.Assert(got[0].NodeID, qt.Equals, want.Logs[0].NodeID)
+	c.Assert(got[1].PhysicalTraffic, qt.DeepEquals, want.Logs[1].PhysicalTraffic)
+
+	// The message is reused, fields of the previous one must not leak
+	var exits []int
+	body := `{"other": {"a": [1]}, "logs": [
+		{"nodeId": "a", "exitTraffic": [{"src": "100.1.1.1:0", "dst": "1.1.1.1:0"}]},
+		{"nodeId": "b"}
+	]}`
+	err = decodeLogs(strings.NewReader(body), func(msg *Message) {
+		exits = append(exits, len(msg.ExitTraffic))
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(exits, qt.DeepEquals, []int{1, 0})
+
+	c.Assert(decodeLogs(strings.NewReader(`{"logs": null}`), func(*Message) {}), qt.IsNil)
+	c.Assert(decodeLogs(strings.NewReader(`[]`), func(*Message) {}), qt.ErrorMatches, "expected {.*")
+	c.Assert(decodeLogs(strings.NewReader(`{"logs": {}}`), func(*Message) {}), qt.ErrorMatches, "logs: expected an array.*")
+
+	err = decodeLogs(bytes.NewReader(logOne[:len(logOne)/2]), func(*Message) {})
+	c.Assert(err, qt.ErrorMatches, "unexpected EOF")
+}
+
+func TestMaxBytesReader(t *testing.T) {
+	c := qt.New(t)
+	b, err := io.ReadAll(&maxBytesReader{r: strings.NewReader("12345"), max: 5})
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(b), qt.Equals, "12345")
+
+	_, err = io.ReadAll(&maxBytesReader{r: strings.NewReader("123456"), max: 5})
+	c.Assert(errors.Is(err, errResponseTooLarge), qt.IsTrue)
+}
+
+func TestGetNewLogDataGzip(t *testing.T) {
+	c := qt.New(t)
+
+	fake := newFakeAPI(t, "gzip-tailnet", "gzip-id", "gzip-secret")
+	var logs APILogResponse
+	c.Assert(json.Unmarshal(logOne, &logs), qt.IsNil)
+	now := time.Now()
+	fake.AddLogs(shiftLogs(logs.Logs, now.Add(-time.Second))...)
+
+	a := &AppConfig{
+		APIBaseURL:   fake.APIURL(),
+		Transport:    newTestRetryClient().Transport,
+		TailNetName:  fake.Tailnet,
+		ClientId:     fake.ClientID,
+		ClientSecret: fake.ClientSecret,
+		LMData:       &LogMetricData{},
+		Cursor:       now.Add(-time.Minute),
+		// Way smaller than the response
+		MaxResponseBytes: 100,
+	}
+	a.LMData.Init()
+	ctx := context.Background()
+	client := a.getOAuthClient(ctx)
+
+	err := a.getNewLogData(ctx, client)
+	c.Assert(errorKind(err), qt.Equals, tooLargeErrorKind)
+	c.Assert(a.Cursor, qt.Equals, now.Add(-time.Minute))
+
+	a.MaxResponseBytes = 1 << 20
+	c.Assert(a.getNewLogData(ctx, client), qt.IsNil)
+	c.Assert(a.Cursor.Before(now.Add(-time.Second)), qt.IsFalse)
+	c.Assert(a.LMData.data, qt.Not(qt.HasLen), 0)
+
+	reqs := fake.Requests("network-logs")
+	c.Assert(reqs[len(reqs)-1].Header.Get("Accept-Encoding"), qt.Equals, "gzip")
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// logGenConfig describes a synthetic tailnet for generateLogs.
+type logGenConfig struct {
+	// Nodes is the number of nodes reporting network logs.
+	Nodes int
+	// Peers is how many other nodes each node talks to.
+	Peers int
+	// Counts is the number of connection counts in a message.
+	Counts int
+	// Mix is the relative weight of virtual, subnet, exit and physical
+	// traffic in the connection counts.
+	Mix [4]int
+	// Ports are the destination ports, picked uniformly.
+	Ports []uint16
+	// Messages are logged from Start to Start+Span, one per node every
+	// Interval.
+	Start    time.Time
+	Span     time.Duration
+	Interval time.Duration
+	Seed     uint64
+}
+
+// defaultLogGenConfig is a mid size tailnet: 100 nodes logging every 5
+// seconds for a minute.
+func defaultLogGenConfig() logGenConfig {
+	return logGenConfig{
+		Nodes:    100,
+		Peers:    10,
+		Counts:   8,
+		Mix:      [4]int{70, 10, 10, 10},
+		Ports:    []uint16{22, 53, 80, 443, 3000, 5432, 8080, 9100},
+		Start:    time.Date(2022, 10, 28, 22, 40, 0, 0, time.UTC),
+		Span:     time.Minute,
+		Interval: 5 * time.Second,
+		Seed:     1,
+	}
+}
+
+// nodeAddr returns the tailscale address of node i.
+func nodeAddr(i int) netip.Addr {
+	return netip.AddrFrom4([4]byte{100, 64 + byte(i>>16), byte(i >> 8), byte(i)})
+}
+
+// generateLogs returns a network logs response for the tailnet described by
+// cfg. The same config always generates the same response.
+func generateLogs(cfg logGenConfig) APILogResponse {
+	r := rand.New(rand.NewPCG(cfg.Seed, cfg.Seed))
+	weight := 0
+	for _, w := range cfg.Mix {
+		weight += w
+	}
+	pickType := func() TrafficType {
+		n := r.IntN(weight)
+		for tt, w := range cfg.Mix {
+			if n < w {
+				return TrafficType(tt)
+			}
+			n -= w
+		}
+		return VirtualTraffic
+	}
+	peer := func(i int) netip.Addr {
+		// Peers are the next nodes, so every node has a stable set
+		return nodeAddr((i + 1 + r.IntN(cfg.Peers)) % cfg.Nodes)
+	}
+	ephemeral := func() uint16 {
+		return uint16(32768 + r.IntN(28232))
+	}
+
+	resp := APILogResponse{Logs: []Message{}}
+	for t := cfg.Start; t.Before(cfg.Start.Add(cfg.Span)); t = t.Add(cfg.Interval) {
+		for i := 0; i < cfg.Nodes; i++ {
+			src := nodeAddr(i)
+			msg := Message{
+				NodeID: fmt.Sprintf("n%dCNTRL", i),
+				Start:  t,
+				End:    t.Add(cfg.Interval),
+				Logged: t.Add(cfg.Interval + time.Duration(r.IntN(1000))*time.Millisecond),
+			}
+			for range cfg.Counts {
+				cc := ConnectionCounts{
+					Proto:     []uint8{6, 17}[r.IntN(2)],
+					TxPackets: uint64(1 + r.IntN(1000)),
+					RxPackets: uint64(1 + r.IntN(1000)),
+				}
+				cc.TxBytes = cc.TxPackets * uint64(64+r.IntN(1400))
+				cc.RxBytes = cc.RxPackets * uint64(64+r.IntN(1400))
+				port := cfg.Ports[r.IntN(len(cfg.Ports))]
+
+				switch tt := pickType(); tt {
+				case VirtualTraffic:
+					cc.Src = netip.AddrPortFrom(src, ephemeral()).String()
+					cc.Dst = netip.AddrPortFrom(peer(i), port).String()
+					msg.VirtualTraffic = append(msg.VirtualTraffic, cc)
+				case SubnetTraffic:
+					dst := netip.AddrFrom4([4]byte{10, 0, byte(r.IntN(4)), byte(r.IntN(256))})
+					cc.Src = netip.AddrPortFrom(src, ephemeral()).String()
+					cc.Dst = netip.AddrPortFrom(dst, port).String()
+					msg.SubnetTraffic = append(msg.SubnetTraffic, cc)
+				case ExitTraffic:
+					dst := netip.AddrFrom4([4]byte{byte(1 + r.IntN(223)), byte(r.IntN(256)), byte(r.IntN(256)), byte(r.IntN(256))})
+					cc.Src = netip.AddrPortFrom(src, 0).String()
+					cc.Dst = netip.AddrPortFrom(dst, 0).String()
+					cc.Proto = 0
+					msg.ExitTraffic = append(msg.ExitTraffic, cc)
+				case PhysicalTraffic:
+					dst := netip.AddrFrom4([4]byte{192, 168, byte(i >> 8), byte(i)})
+					cc.Src = netip.AddrPortFrom(peer(i), 0).String()
+					cc.Dst = netip.AddrPortFrom(dst, 41641).String()
+					cc.Proto = 0
+					msg.PhysicalTraffic = append(msg.PhysicalTraffic, cc)
+				}
+			}
+			resp.Logs = append(resp.Logs, msg)
+		}
+	}
+	return resp
+}
+
+func TestGenerateLogs(t *testing.T) {
+	c := qt.New(t)
+	cfg := defaultLogGenConfig()
+	resp := generateLogs(cfg)
+	c.Assert(resp.Logs, qt.HasLen, 12*cfg.Nodes)
+	c.Assert(generateLogs(cfg), qt.DeepEquals, resp)
+
+	m := LogMetricData{}
+	m.Init()
+	m.SaveNewData(resp)
+	counts := map[TrafficType]int{}
+	for le := range m.data {
+		counts[le.TrafficType]++
+		c.Assert(le.Src.IsValid(), qt.IsTrue)
+		c.Assert(le.Dst.IsValid(), qt.IsTrue)
+	}
+	for tt := range cfg.Mix {
+		c.Assert(counts[TrafficType(tt)] > 0, qt.IsTrue, qt.Commentf("%s", TrafficType(tt)))
+	}
+}
+
+// quietLogs silences the log package for the benchmark, the ingest path
+// logs on every call.
+func quietLogs(b *testing.B) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+}
+
+// benchLogSizes are the tailnet sizes the ingest benchmarks run with.
+var benchLogSizes = []int{100, 1000}
@@ -3,9 +3,8 @@ package main
 import (
 	"fmt"
 	"log"
-	"net"
 	"net/netip"
-	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -35,137 +34,225 @@ const (
 	PhysicalTraffic
 )
 
+// parseTrafficType returns the traffic type named s.
+func parseTrafficType(s string) (TrafficType, bool) {
+	for tt := VirtualTraffic; tt <= PhysicalTraffic; tt++ {
+		if tt.String() == s {
+			return tt, true
+		}
+	}
+	return 0, false
+}
+
+// LogEntry is what the traffic is aggregated by, the labels of the
+// traffic metrics. Addresses are parsed once when the entry is built so
+// the key is small and cheap to hash.
 type LogEntry struct {
-	Src         string
-	Dst         string
+	Src         netip.Addr
+	Dst         netip.Addr
 	TrafficType TrafficType
 	Proto       uint8
-	CountType   string
+	// SrcPort and DstPort are noPort unless their label is exported, and
+	// Service unless the service label is.
+	SrcPort portLabel
+	DstPort portLabel
+	Service portLabel
+	// Reporter is the node id of the node that logged the traffic, empty
+	// unless the reporter label is exported.
+	Reporter string
 }
 
-func hostOnly(s string) string {
-	host, _, err := net.SplitHostPort(s)
-	if err != nil {
-		return "-"
+// LogCounts are the four counters of a LogEntry.
+type LogCounts struct {
+	TxPackets uint64
+	TxBytes   uint64
+	RxPackets uint64
+	RxBytes   uint64
+}
+
+// parseAddr returns the address of an "ip:port" (or bare ip, exit traffic
+// can come without the port). The zero Addr if it does not parse.
+func parseAddr(s string) netip.Addr {
+	addr, _ := parseAddrPort(s)
+	return addr
+}
+
+// parseAddrPort is parseAddr that also returns the port, 0 when there is
+// none.
+func parseAddrPort(s string) (netip.Addr, uint16) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr(), ap.Port()
 	}
+	addr, _ := netip.ParseAddr(s)
+	return addr, 0
+}
 
-	ip := net.ParseIP(host)
-	if ip == nil {
+// addrLabel is the label value of an address: its name if we know it, "-"
+// if it did not parse.
+func addrLabel(addr netip.Addr, namesByAddr map[netip.Addr]string) string {
+	if !addr.IsValid() {
 		return "-"
 	}
-
-	return ip.String()
+	if name, ok := namesByAddr[addr]; ok {
+		return name
+	}
+	return addr.String()
 }
 
 func (l *LogEntry) String() string {
-	return fmt.Sprintf(`%s_%s_%d_%d_%s`, l.Src, l.Dst, l.TrafficType, l.Proto, l.CountType)
+	return fmt.Sprintf(`%s_%s_%d_%d_%s_%s_%s_%s`, l.Src, l.Dst, l.TrafficType, l.Proto, l.SrcPort, l.DstPort, l.Service, l.Reporter)
 }
 
-type MapLogEntryToValue map[LogEntry]uint64
+type MapLogEntryToValue map[LogEntry]LogCounts
+
+var duplicateMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsmetrics_duplicate_messages_total",
+	Help: "Network log messages skipped because they were already ingested",
+}, []string{"tailnet"})
 
 type LogMetricData struct {
-	data MapLogEntryToValue
+	// Tailnet is the tailnet label of the ingest metrics
+	Tailnet string
+	data    MapLogEntryToValue
+	// reporters are the messages of every node id
+	reporters map[string]uint64
+	// seen outlives Init() so duplicates are caught across polls
+	seen *messageSet
+	// SkipTypes are the traffic types that are not aggregated
+	SkipTypes [4]bool
+	// Ports labels the ports of the traffic
+	Ports portLabeler
+	// Reporter aggregates the traffic by the node that logged it
+	Reporter bool
+}
+
+// logSettings are the settings of LogMetricData a reload changes.
+type logSettings struct {
+	SkipTypes [4]bool
+	Ports     portLabeler
+	Reporter  bool
+}
+
+func (m *LogMetricData) apply(s logSettings) {
+	m.SkipTypes, m.Ports, m.Reporter = s.SkipTypes, s.Ports, s.Reporter
 }
 
 func (m *LogMetricData) Init() {
 	m.data = make(MapLogEntryToValue)
+	m.reporters = make(map[string]uint64)
+	if m.seen == nil {
+		m.seen = newMessageSet()
+	}
+}
+
+// Forget drops the messages logged before t from the ones ingested, once
+// no log window can return them again.
+func (m *LogMetricData) Forget(t time.Time) {
+	m.seen.Forget(t)
+}
+
+// ingestStats counts what a poll ingested, for the logs and the exporter
+// metrics.
+type ingestStats struct {
+	messages int
+	dups     int
+	counts   [4]int
 }
 
 func (m *LogMetricData) SaveNewData(apiResponse APILogResponse) {
-	log.Printf("getNewLogData(): %d new messages", len(apiResponse.Logs))
-	mc := []int{0, 0, 0, 0}
-	for _, msg := range apiResponse.Logs {
-		mc[0] += len(msg.VirtualTraffic)
+	var st ingestStats
+	for i := range apiResponse.Logs {
+		m.SaveMessage(&apiResponse.Logs[i], &st)
+	}
+	m.RecordIngest(st)
+}
+
+// SaveMessage aggregates the connection counts of one message unless it was
+// already ingested.
+func (m *LogMetricData) SaveMessage(msg *Message, st *ingestStats) {
+	if !m.seen.Add(msg) {
+		st.dups++
+		return
+	}
+	st.messages++
+	m.reporters[msg.NodeID]++
+	var reporter string
+	if m.Reporter {
+		reporter = msg.NodeID
+	}
+
+	if !m.SkipTypes[VirtualTraffic] {
+		st.counts[VirtualTraffic] += len(msg.VirtualTraffic)
 		for _, cc := range msg.VirtualTraffic {
-			m.Update(&cc, VirtualTraffic)
+			m.Update(&cc, VirtualTraffic, reporter)
 		}
+	}
 
-		mc[1] += len(msg.SubnetTraffic)
+	if !m.SkipTypes[SubnetTraffic] {
+		st.counts[SubnetTraffic] += len(msg.SubnetTraffic)
 		for _, cc := range msg.SubnetTraffic {
-			m.Update(&cc, SubnetTraffic)
+			m.Update(&cc, SubnetTraffic, reporter)
 		}
+	}
 
-		mc[2] += len(msg.ExitTraffic)
+	if !m.SkipTypes[ExitTraffic] {
+		st.counts[ExitTraffic] += len(msg.ExitTraffic)
 		for _, cc := range msg.ExitTraffic {
-			m.Update(&cc, ExitTraffic)
+			m.Update(&cc, ExitTraffic, reporter)
 		}
+	}
 
-		mc[3] += len(msg.PhysicalTraffic)
+	if !m.SkipTypes[PhysicalTraffic] {
+		st.counts[PhysicalTraffic] += len(msg.PhysicalTraffic)
 		for _, cc := range msg.PhysicalTraffic {
-			m.Update(&cc, PhysicalTraffic)
+			m.Update(&cc, PhysicalTraffic, reporter)
 		}
 	}
+}
+
+// RecordIngest logs and exports the stats of a poll.
+func (m *LogMetricData) RecordIngest(st ingestStats) {
+	mc := st.counts
+	duplicateMessages.WithLabelValues(m.Tailnet).Add(float64(st.dups))
+	messagesIngested.WithLabelValues(m.Tailnet).Add(float64(st.messages))
+	for tt, n := range mc {
+		connectionCountsIngested.WithLabelValues(m.Tailnet, TrafficType(tt).String()).Add(float64(n))
+	}
+	logMetricDataEntries.WithLabelValues(m.Tailnet).Set(float64(len(m.data)))
+	log.Printf("getNewLogData(): %d new messages", st.messages)
+	log.Printf("getNewLogData(): %d duplicated messages skipped", st.dups)
 	log.Printf("getNewLogData(): counts Virtual:%d | Subnet: %d | Exit: %d | Physical: %d",
 		mc[0], mc[1], mc[2], mc[3])
 	log.Printf("getNewLogData(): Number of LogMetricData entries: %d", len(m.data))
 }
 
-// Update based on the data from a new log entry (counts)
-func (m *LogMetricData) Update(cc *ConnectionCounts, tt TrafficType) {
+// Update based on the data from a new log entry (counts) logged by the
+// node id reporter.
+func (m *LogMetricData) Update(cc *ConnectionCounts, tt TrafficType, reporter string) {
+	src, srcPort := parseAddrPort(cc.Src)
+	dst, dstPort := parseAddrPort(cc.Dst)
 	le := LogEntry{
-		hostOnly(cc.Src),
-		hostOnly(cc.Dst),
+		src,
+		dst,
 		tt,
 		cc.Proto,
-		"",
-	}
-	le.CountType = "TxPackets"
-	m.data[le] += cc.TxPackets
-	le.CountType = "RxPackets"
-	m.data[le] += cc.RxPackets
-	le.CountType = "TxBytes"
-	m.data[le] += cc.TxBytes
-	le.CountType = "RxBytes"
-	m.data[le] += cc.RxBytes
-}
-
-func toNetIp(addrString string) (*netip.Addr, error) {
-	addr, err := netip.ParseAddr(addrString)
-	if err != nil {
-		return nil, err
-	}
-	return &addr, nil
-}
-
-// Given a metric name and the actual metric,
-// add the latest values collected to the metric
-func (m *LogMetricData) AddCounter(metricName string, cv *prometheus.CounterVec, namesByAddr map[netip.Addr]string) {
-	add := func(le LogEntry, value uint64) {
-		s := le.Src
-		d := le.Dst
-		if namesByAddr != nil {
-			sNetIp, err := toNetIp(s)
-			if err == nil {
-				if h, ok := namesByAddr[*sNetIp]; ok {
-					s = h
-				}
-			}
-			dNetIp, err := toNetIp(d)
-			if err == nil {
-				if h, ok := namesByAddr[*dNetIp]; ok {
-					d = h
-				}
-			}
-		}
-		cv.WithLabelValues(
-			s,
-			d,
-			le.TrafficType.String(),
-			fmt.Sprintf("%d", le.Proto)).Add(float64(value))
-	}
-
-	for le, value := range m.data {
-		if strings.Contains(metricName, "tx_bytes") && le.CountType == "TxBytes" {
-			add(le, value)
-		}
-		if strings.Contains(metricName, "rx_bytes") && le.CountType == "RxBytes" {
-			add(le, value)
-		}
-		if strings.Contains(metricName, "tx_packets") && le.CountType == "TxPackets" {
-			add(le, value)
-		}
-		if strings.Contains(metricName, "rx_packets") && le.CountType == "RxPackets" {
-			add(le, value)
-		}
+		m.Ports.label(srcPort, m.Ports.src),
+		m.Ports.label(dstPort, m.Ports.dst),
+		m.Ports.service(srcPort, dstPort),
+		reporter,
 	}
+	c := m.data[le]
+	c.TxPackets += cc.TxPackets
+	c.TxBytes += cc.TxBytes
+	c.RxPackets += cc.RxPackets
+	c.RxBytes += cc.RxBytes
+	m.data[le] = c
 }
+
+// Names of the traffic metrics.
+const (
+	txBytesMetric   = "tailscale_tx_bytes"
+	rxBytesMetric   = "tailscale_rx_bytes"
+	txPacketsMetric = "tailscale_tx_packets"
+	rxPacketsMetric = "tailscale_rx_packets"
+)
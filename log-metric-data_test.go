@@ -1,9 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestMetricData(t *testing.T) {
@@ -23,25 +28,141 @@ func TestMetricData(t *testing.T) {
 		3,
 		4,
 	}
-	mData.Update(cc, VirtualTraffic)
-
-	m := map[string]uint64{
-		"TxPackets": 1,
-		"TxBytes":   2,
-		"RxPackets": 3,
-		"RxBytes":   4,
-	}
-	for k, v := range m {
-		le := LogEntry{
-			hostOnly(cc.Src),
-			hostOnly(cc.Dst),
-			VirtualTraffic,
-			cc.Proto,
-			k,
-		}
-		c := qt.New(t)
-		c.Assert(mData.data[le], qt.Equals, v)
+	mData.Update(cc, VirtualTraffic, "")
+	mData.Update(cc, VirtualTraffic, "")
+
+	le := LogEntry{
+		netip.MustParseAddr("100.1.1.1"),
+		netip.MustParseAddr("100.2.2.2"),
+		VirtualTraffic,
+		cc.Proto,
+		noPort,
+		noPort,
+		noPort,
+		"",
+	}
+	c := qt.New(t)
+	c.Assert(mData.data, qt.HasLen, 1)
+	c.Assert(mData.data[le], qt.Equals, LogCounts{TxPackets: 2, TxBytes: 4, RxPackets: 6, RxBytes: 8})
+}
+
+func TestParseAddr(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(parseAddr("100.1.1.1:1111"), qt.Equals, netip.MustParseAddr("100.1.1.1"))
+	c.Assert(parseAddr("[fd7a:115c:a1e0::1]:443"), qt.Equals, netip.MustParseAddr("fd7a:115c:a1e0::1"))
+	c.Assert(parseAddr("100.1.1.1"), qt.Equals, netip.MustParseAddr("100.1.1.1"))
+	c.Assert(parseAddr("100.99.888.77:0").IsValid(), qt.IsFalse)
+	c.Assert(parseAddr("").IsValid(), qt.IsFalse)
+}
+
+func TestSkipTypes(t *testing.T) {
+	c := qt.New(t)
+	m := LogMetricData{SkipTypes: [4]bool{ExitTraffic: true, PhysicalTraffic: true}}
+	m.Init()
+	m.SaveNewData(generateLogs(defaultLogGenConfig()))
+	c.Assert(len(m.data) > 0, qt.IsTrue)
+	for le := range m.data {
+		c.Assert(le.TrafficType == VirtualTraffic || le.TrafficType == SubnetTraffic, qt.IsTrue, qt.Commentf("%s", le.TrafficType))
+	}
+
+	tt, ok := parseTrafficType("exit")
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(tt, qt.Equals, ExitTraffic)
+	_, ok = parseTrafficType("invalidTrafficType")
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestReporters(t *testing.T) {
+	c := qt.New(t)
+	var resp APILogResponse
+	c.Assert(json.Unmarshal(logOne, &resp), qt.IsNil)
+
+	m := LogMetricData{}
+	m.Init()
+	m.SaveNewData(resp)
+	c.Assert(m.reporters, qt.DeepEquals, map[string]uint64{"aBcdef1CNTRL": 1, "uvwXyz2CNTRL": 1})
+	for le := range m.data {
+		c.Assert(le.Reporter, qt.Equals, "")
+	}
+
+	m = LogMetricData{Reporter: true}
+	m.Init()
+	m.SaveNewData(resp)
+	reporters := map[string]bool{}
+	for le := range m.data {
+		reporters[le.Reporter] = true
+	}
+	c.Assert(reporters, qt.DeepEquals, map[string]bool{"aBcdef1CNTRL": true, "uvwXyz2CNTRL": true})
+}
+
+func TestDuplicateMessages(t *testing.T) {
+	c := qt.New(t)
+	var resp APILogResponse
+	c.Assert(json.Unmarshal(logOne, &resp), qt.IsNil)
+
+	mData := LogMetricData{}
+	mData.Init()
+	mData.SaveNewData(resp)
+	once := make(MapLogEntryToValue)
+	for k, v := range mData.data {
+		once[k] = v
+	}
+
+	before := testutil.ToFloat64(duplicateMessages.WithLabelValues(mData.Tailnet))
+	mData.SaveNewData(resp)
+	c.Assert(mData.data, qt.DeepEquals, once)
+	c.Assert(testutil.ToFloat64(duplicateMessages.WithLabelValues(mData.Tailnet))-before, qt.Equals, float64(len(resp.Logs)))
+
+	// The seen messages survive Init()
+	mData.Init()
+	mData.SaveNewData(resp)
+	c.Assert(len(mData.data), qt.Equals, 0)
+}
+
+func TestMessageSetForget(t *testing.T) {
+	c := qt.New(t)
+	s := newMessageSet()
+	t0 := time.Date(2022, 10, 28, 22, 40, 0, 0, time.UTC)
+	msg := func(node string, logged time.Time) *Message {
+		return &Message{NodeID: node, Logged: logged, Start: logged.Add(-5 * time.Second), End: logged}
+	}
+
+	c.Assert(s.Add(msg("a", t0)), qt.IsTrue)
+	c.Assert(s.Add(msg("a", t0)), qt.IsFalse)
+	c.Assert(s.Add(msg("b", t0)), qt.IsTrue)
+
+	// However many messages there are, they are only forgotten by time
+	for i := range 1000 {
+		c.Assert(s.Add(msg(fmt.Sprint("d", i), t0.Add(time.Minute))), qt.IsTrue)
 	}
+	c.Assert(s.Add(msg("a", t0)), qt.IsFalse)
+	c.Assert(s.Len(), qt.Equals, 1002)
+
+	s.Forget(t0.Add(time.Second))
+	c.Assert(s.Len(), qt.Equals, 1000)
+	c.Assert(s.Add(msg("a", t0)), qt.IsTrue)
+	c.Assert(s.Add(msg("d0", t0.Add(time.Minute))), qt.IsFalse)
 }
 
 // TODO: test hostname resolve
+
+func BenchmarkSaveNewData(b *testing.B) {
+	quietLogs(b)
+	for _, nodes := range benchLogSizes {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			cfg := defaultLogGenConfig()
+			cfg.Nodes = nodes
+			resp := generateLogs(cfg)
+			b.ReportAllocs()
+			for b.Loop() {
+				// A fresh set each time or every message is a duplicate
+				b.StopTimer()
+				m := LogMetricData{}
+				m.Init()
+				b.StartTimer()
+				m.SaveNewData(resp)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(resp.Logs)), "ns/msg")
+		})
+	}
+}
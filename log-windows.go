@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// subWindowAttempts is how many times a sub window is fetched before the
+// poll gives up on it. The transport already retries HTTP errors, this
+// covers responses that break halfway.
+const subWindowAttempts = 3
+
+var logWindowRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tsmetrics_log_window_retries_total",
+	Help: "Network logs sub windows fetched again after a failure",
+}, []string{"tailnet"})
+
+type timeRange struct {
+	Start, End time.Time
+}
+
+func (r timeRange) String() string {
+	return r.Start.UTC().Format(time.RFC3339) + "/" + r.End.UTC().Format(time.RFC3339)
+}
+
+// splitWindow splits [start, end] in consecutive ranges of at most size. A
+// zero size does not split.
+func splitWindow(start, end time.Time, size time.Duration) []timeRange {
+	if size <= 0 || end.Sub(start) <= size {
+		return []timeRange{{start, end}}
+	}
+	var windows []timeRange
+	for s := start; s.Before(end); s = s.Add(size) {
+		e := s.Add(size)
+		if e.After(end) {
+			e = end
+		}
+		windows = append(windows, timeRange{s, e})
+	}
+	return windows
+}
+
+type subWindowResult struct {
+	msgs []Message
+	err  error
+	done chan struct{}
+}
+
+// fetchSubWindows fetches the windows with up to LogFetchers requests in
+// flight and ingests them in order as soon as all the previous ones are in.
+// The cursor moves after every window, so if one keeps failing the poll
+// stops there and the next one starts from it.
+//
+// The messages of a window are held until it is ingested. A window is only
+// fetched when there are less than LogFetchers windows fetched or being
+// fetched and not ingested yet, so a slow window does not make us buffer
+// all the ones after it.
+func (a *AppConfig) fetchSubWindows(ctx context.Context, client LogClient, windows []timeRange, st *ingestStats) error {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	results := make([]subWindowResult, len(windows))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+
+	// Windows are handed out in order so the oldest ones, the ones we
+	// ingest first, are fetched first. Every window takes a slot until
+	// it is ingested.
+	fetchers := min(max(a.LogFetchers, 1), len(windows))
+	slots := make(chan struct{}, fetchers)
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range windows {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for range fetchers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				r := &results[i]
+				r.msgs, r.err = a.fetchSubWindow(ctx, client, windows[i])
+				close(r.done)
+			}
+		}()
+	}
+
+	for i, w := range windows {
+		r := &results[i]
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.err != nil {
+			return fmt.Errorf("window %s: %w", w, r.err)
+		}
+		sort.SliceStable(r.msgs, func(i, j int) bool {
+			return r.msgs[i].Logged.Before(r.msgs[j].Logged)
+		})
+		var newest time.Time
+		for j := range r.msgs {
+			a.ingestMessage(&r.msgs[j], st, &newest)
+		}
+		a.advanceCursor(newest, w.End)
+		r.msgs = nil
+		<-slots
+	}
+	return nil
+}
+
+// fetchSubWindow fetches the messages of one window, trying again if it
+// fails.
+func (a *AppConfig) fetchSubWindow(ctx context.Context, client LogClient, w timeRange) ([]Message, error) {
+	for attempt := 1; ; attempt++ {
+		var msgs []Message
+		err := a.fetchLogs(ctx, client, w.Start, w.End, func(msg *Message) {
+			msgs = append(msgs, cloneMessage(msg))
+		})
+		if err == nil || attempt == subWindowAttempts || ctx.Err() != nil {
+			return msgs, err
+		}
+		log.Printf("getNewLogData(): window %s failed (attempt %d), retrying: %s", w, attempt, err)
+		logWindowRetries.WithLabelValues(a.TailNetName).Inc()
+	}
+}
+
+// cloneMessage copies msg, decodeLogs reuses it.
+func cloneMessage(msg *Message) Message {
+	m := *msg
+	m.VirtualTraffic = slices.Clone(msg.VirtualTraffic)
+	m.SubnetTraffic = slices.Clone(msg.SubnetTraffic)
+	m.ExitTraffic = slices.Clone(msg.ExitTraffic)
+	m.PhysicalTraffic = slices.Clone(msg.PhysicalTraffic)
+	return m
+}
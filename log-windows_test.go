@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSplitWindow(t *testing.T) {
+	c := qt.New(t)
+	start := time.Date(2022, 10, 28, 22, 40, 0, 0, time.UTC)
+
+	c.Assert(splitWindow(start, start.Add(time.Minute), 0), qt.DeepEquals,
+		[]timeRange{{start, start.Add(time.Minute)}})
+	c.Assert(splitWindow(start, start.Add(time.Minute), 5*time.Minute), qt.HasLen, 1)
+
+	windows := splitWindow(start, start.Add(11*time.Minute), 5*time.Minute)
+	c.Assert(windows, qt.DeepEquals, []timeRange{
+		{start, start.Add(5 * time.Minute)},
+		{start.Add(5 * time.Minute), start.Add(10 * time.Minute)},
+		{start.Add(10 * time.Minute), start.Add(11 * time.Minute)},
+	})
+}
+
+// subWindowNow is the clock of the sub window tests, so the windows are
+// always the same.
+var subWindowNow = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newSubWindowTest serves ten minutes of synthetic logs ending a minute
+// before subWindowNow and returns an app whose cursor is right before
+// them, fetching one minute windows.
+func newSubWindowTest(t *testing.T) (*fakeAPI, *AppConfig, LogMetricData) {
+	fake := newFakeAPI(t, "windows-tailnet", "windows-id", "windows-secret")
+	cfg := defaultLogGenConfig()
+	cfg.Nodes = 3
+	cfg.Span = 10 * time.Minute
+	cfg.Start = subWindowNow.Add(-11 * time.Minute)
+	logs := generateLogs(cfg)
+	fake.AddLogs(logs.Logs...)
+
+	// What ingesting everything at once gives
+	want := LogMetricData{}
+	want.Init()
+	want.SaveNewData(logs)
+
+	a := &AppConfig{
+		APIBaseURL:       fake.APIURL(),
+		Transport:        newTestRetryClient().Transport,
+		TailNetName:      fake.Tailnet,
+		ClientId:         fake.ClientID,
+		ClientSecret:     fake.ClientSecret,
+		LMData:           &LogMetricData{},
+		Cursor:           cfg.Start.Add(-time.Second),
+		LogWindowSeconds: 60,
+		LogFetchers:      4,
+		now:              func() time.Time { return subWindowNow },
+	}
+	a.LMData.Init()
+	return fake, a, want
+}
+
+func TestFetchSubWindows(t *testing.T) {
+	c := qt.New(t)
+	fake, a, want := newSubWindowTest(t)
+	// One sub window breaks once, only that one is fetched again
+	fake.Fail("network-logs", fakeFailure{}, fakeFailure{Truncate: true})
+	retries := testutil.ToFloat64(logWindowRetries.WithLabelValues(a.TailNetName))
+
+	ctx := context.Background()
+	c.Assert(a.getNewLogData(ctx, a.getOAuthClient(ctx)), qt.IsNil)
+	c.Assert(a.LMData.data, qt.DeepEquals, want.data)
+	c.Assert(testutil.ToFloat64(logWindowRetries.WithLabelValues(a.TailNetName))-retries, qt.Equals, 1.0)
+	// 11 minutes and a second: 12 windows
+	c.Assert(windowsRequested(fake.Requests("network-logs")), qt.Equals, 12)
+}
+
+// windowsRequested counts the distinct windows among the log requests,
+// retries aside.
+func windowsRequested(reqs []*http.Request) int {
+	starts := make(map[string]bool)
+	for _, r := range reqs {
+		starts[r.URL.Query().Get("start")] = true
+	}
+	return len(starts)
+}
+
+func TestFetchSubWindowsFailure(t *testing.T) {
+	c := qt.New(t)
+	fake, a, want := newSubWindowTest(t)
+	a.LogFetchers = 1
+	// The third window fails every attempt
+	fake.Fail("network-logs", fakeFailure{}, fakeFailure{},
+		fakeFailure{Truncate: true}, fakeFailure{Truncate: true}, fakeFailure{Truncate: true})
+	start := a.Cursor
+
+	ctx := context.Background()
+	err := a.getNewLogData(ctx, a.getOAuthClient(ctx))
+	c.Assert(errorKind(err), qt.Equals, decodeErrorKind)
+	// The cursor is within the second window
+	c.Assert(a.Cursor.After(start.Add(time.Minute)), qt.IsTrue)
+	c.Assert(a.Cursor.After(start.Add(2*time.Minute)), qt.IsFalse)
+	c.Assert(len(a.LMData.data) < len(want.data), qt.IsTrue)
+
+	// The next poll picks up from there
+	c.Assert(a.getNewLogData(ctx, a.getOAuthClient(ctx)), qt.IsNil)
+	c.Assert(a.LMData.data, qt.DeepEquals, want.data)
+}
+
+// blockingLogClient holds the requests of the first window until Release
+// and records the requests made.
+type blockingLogClient struct {
+	LogClient
+	first   string
+	release chan struct{}
+
+	mu       sync.Mutex
+	reqs     []*http.Request
+	held     int // requests made before Release
+	answered int // requests answered
+}
+
+func (b *blockingLogClient) Do(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	b.reqs = append(b.reqs, req)
+	select {
+	case <-b.release:
+	default:
+		b.held++
+	}
+	b.mu.Unlock()
+	if req.URL.Query().Get("start") == b.first {
+		<-b.release
+	}
+	resp, err := b.LogClient.Do(req)
+	b.mu.Lock()
+	b.answered++
+	b.mu.Unlock()
+	return resp, err
+}
+
+// Release lets the first window through and returns how many requests
+// were made while it was held.
+func (b *blockingLogClient) Release() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.release)
+	return b.held
+}
+
+func (b *blockingLogClient) answeredRequests() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.answered
+}
+
+func (b *blockingLogClient) requests() []*http.Request {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.reqs)
+}
+
+func TestFetchSubWindowsReadAhead(t *testing.T) {
+	c := qt.New(t)
+	_, a, want := newSubWindowTest(t)
+	a.LogFetchers = 3
+	ctx := context.Background()
+	start, _ := a.logWindow(subWindowNow)
+	client := &blockingLogClient{
+		LogClient: a.getOAuthClient(ctx),
+		first:     start.UTC().Format(logApiDateFormat),
+		release:   make(chan struct{}),
+	}
+
+	done := make(chan error)
+	go func() { done <- a.getNewLogData(ctx, client) }()
+	// While the first window is stuck the next two are fetched, and
+	// nothing after them
+	deadline := time.Now().Add(5 * time.Second)
+	for client.answeredRequests() < 2 {
+		if time.Now().After(deadline) {
+			c.Fatalf("%d windows answered, want 2", client.answeredRequests())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(client.Release(), qt.Equals, 3)
+	c.Assert(<-done, qt.IsNil)
+	c.Assert(a.LMData.data, qt.DeepEquals, want.data)
+	c.Assert(windowsRequested(client.requests()), qt.Equals, 12)
+}
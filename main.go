@@ -1,21 +1,24 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
-	"net/netip"
 	"os"
-	"strconv"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	tscg "github.com/tailscale/tailscale-client-go/tailscale"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"tailscale.com/tsnet"
 )
@@ -29,249 +32,494 @@ const (
 )
 
 var (
-	addr          = flag.String("addr", ":9100", "address to listen on")
-	hostname      = flag.String("hostname", "metrics", "hostname to use on the tailnet (metrics)")
-	regularServer = flag.Bool("regular-server", false, "use to create a normal http server")
-	waitTimeSecs  = flag.Int("wait-secs", 45, "waiting time after getting new data")
-	resolveNames  = flag.Bool("resolve-names", false, "convert tailscale IP addresses to hostnames")
+	addr             = flag.String("addr", ":9100", "address to listen on")
+	hostname         = flag.String("hostname", "metrics", "hostname to use on the tailnet (metrics)")
+	regularServer    = flag.Bool("regular-server", false, "use to create a normal http server")
+	waitTimeSecs     = flag.Int("wait-secs", 45, "waiting time after getting new data")
+	devicesWaitSecs  = flag.Int("devices-wait-secs", 0, "time between device refreshes (default: --wait-secs)")
+	namesWaitSecs    = flag.Int("names-wait-secs", 0, "time between name map refreshes (default: --devices-wait-secs)")
+	jitterSecs       = flag.Int("jitter-secs", 0, "largest random delay added to every poll")
+	alignPolls       = flag.Bool("align", false, "poll at multiples of the interval on the wall clock")
+	resolveNames     = flag.Bool("resolve-names", false, "convert tailscale IP addresses to hostnames")
+	stateFile        = flag.String("state-file", "tsmetrics.state.json", "file to persist state between runs (empty disables it)")
+	checkpointSecs   = flag.Int("checkpoint-secs", 60, "how often to save the state file")
+	apiRetriesFlag   = flag.Int("api-retries", 4, "how many times to retry a failed Tailscale API request")
+	apiTimeoutSecs   = flag.Int("api-timeout-secs", 120, "timeout for each Tailscale API request attempt")
+	staleFactor      = flag.Float64("stale-factor", 3, "intervals without a successful poll before /readyz fails")
+	apiURL           = flag.String("api-url", defaultAPIBaseURL, "base URL of the Tailscale API")
+	tokenURL         = flag.String("token-url", "", "OAuth token URL (default: <api-url>/oauth/token)")
+	caBundle         = flag.String("ca-bundle", "", "PEM file with extra CAs to trust when talking to the API")
+	apiProxy         = flag.String("proxy", "", "HTTP(S) proxy for the API requests (default: from the environment)")
+	logWindowSecs    = flag.Int("log-window-secs", 300, "longest time range queried in one network-logs request")
+	logFetchers      = flag.Int("log-fetchers", 4, "network-logs requests in flight when catching up")
+	logDelaySecs     = flag.Int("log-delay-secs", 60, "how far behind now the network-logs queries end, for the messages not queryable yet")
+	logOverlapSecs   = flag.Int("log-overlap-secs", 0, "how far before the cursor the network-logs queries start, for the messages that show up late")
+	maxResponseMB    = flag.Int("max-response-mb", 1024, "largest network-logs response to read, in MiB (0 disables the limit)")
+	configFile       = flag.String("config", "", "HuJSON config file, reloaded on SIGHUP and when it changes")
+	dstPortLabel     = flag.Bool("dst-port-label", false, "label the traffic with its destination port")
+	srcPortLabel     = flag.Bool("src-port-label", false, "label the traffic with its source port")
+	maxSeries        = flag.Int("max-series", 0, "series budget of every traffic metric, the smallest series are folded into other (0 for no limit)")
+	reporterLabel    = flag.Bool("reporter-label", false, "label the traffic with the node that logged it")
+	serviceLabelFlag = flag.Bool("service-label", false, "label the traffic with the service of its ports (needs a port label)")
+	allowedPorts     = portListFlag("ports", defaultPorts, "ports that get a value of their own in the port labels, the rest are other or ephemeral")
 )
 
+// AppConfig is the collector of one tailnet. The exporter runs one for
+// every tailnet it is configured with.
 type AppConfig struct {
-	TailNetName          string
-	ClientId             string
-	ClientSecret         string
-	Server               *tsnet.Server
-	LogMetrics           map[string]*prometheus.CounterVec
-	APIMetrics           map[string]*prometheus.GaugeVec
-	SleepIntervalSeconds int
-	LMData               *LogMetricData
-	NamesByAddr          map[netip.Addr]string
+	TailNetName  string
+	ClientId     string
+	ClientSecret string
+	// APIBaseURL and TokenURL default to the Tailscale API when empty
+	APIBaseURL string
+	TokenURL   string
+	// Transport is used by all the API requests. Nil means the default
+	// retrying transport.
+	Transport http.RoundTripper
+	// Traffic, Devices and Reporters hold the state of the tailnet
+	// metrics.
+	Traffic   *trafficCollector
+	Devices   *deviceCollector
+	Reporters *reporterCollector
+	// Labels are the traffic labels exported
+	Labels LabelsConfig
+	// Schedules are when each loop (logs, devices, names) polls. The
+	// logs one also sizes the first log window.
+	Schedules map[string]schedule
+	// MaxResponseBytes caps the decompressed size of a network-logs
+	// response. Zero means no limit.
+	MaxResponseBytes int64
+	// Windows longer than LogWindowSeconds are split and fetched by up to
+	// LogFetchers requests at a time. Zero means no split.
+	LogWindowSeconds int
+	LogFetchers      int
+	// LogDelaySeconds keeps the end of the log windows behind now. The
+	// logs service takes a while to make the messages it records
+	// queryable, the cursor must not move past the ones we cannot see
+	// yet.
+	LogDelaySeconds int
+	// LogOverlapSeconds starts the log windows before the cursor, for the
+	// messages that become queryable later than LogDelaySeconds. The
+	// message set drops the ones already ingested.
+	LogOverlapSeconds int
+	LMData            *LogMetricData
+	ResolveNames      bool
+	// Names maps Tailscale addresses to device names. It is rebuilt on
+	// every name refresh.
+	Names *nameResolver
+	// Health is shared by all the tailnets, see subsystem.
+	Health *healthTracker
+	// cfgMu guards the settings a reload changes (see applyConfig).
+	cfgMu sync.RWMutex
+	// logSettings are copied into LMData at the start of every log poll.
+	logSettings logSettings
+	// stateMu keeps the saved cursor and the log counters consistent with
+	// each other while the state is captured. It is only held while the
+	// log data is added to the counters, never during a request.
+	stateMu sync.Mutex
+	// Cursor is the Logged timestamp of the last network log message
+	// ingested. Each poll starts LogOverlapSeconds before it.
+	Cursor time.Time
+	// savedCursor is the cursor as of the last time the log data was added
+	// to the counters, the one saved with them.
+	savedCursor time.Time
+	// resumedAt is the cursor restored from the state file. The messages
+	// logged up to it were counted by the previous run, whose message set
+	// is gone.
+	resumedAt time.Time
+
+	// now is time.Now when nil, tests set it
+	now func() time.Time
 }
 
 type APIClient interface {
-	Devices(context.Context) ([]tscg.Device, error)
+	Devices(context.Context) ([]Device, error)
 }
 
 type LogClient interface {
-	Get(string) (*http.Response, error)
+	Do(*http.Request) (*http.Response, error)
 }
 
 func main() {
 	flag.Parse()
 
-	// You need an API access token with network-logs:read
-	clientId := os.Getenv("OAUTH_CLIENT_ID")
-	if clientId == "" {
-		log.Fatal("Please, provide a OAUTH_CLIENT_ID option")
-	}
-	clientSecret := os.Getenv("OAUTH_CLIENT_SECRET")
-	if clientSecret == "" {
-		log.Fatal("Please, provide a OAUTH_CLIENT_SECRET option")
+	// Everything hangs from this context so a SIGINT/SIGTERM stops the
+	// loops, the in-flight requests and the http server.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// You need an API access token with network-logs:read. The
+	// credentials and the tailnet come from the env vars or the config
+	// file.
+	base := flagConfig()
+	cfg := base
+	var err error
+	if *configFile != "" {
+		cfg, err = loadConfig(*configFile, base)
+	} else {
+		err = cfg.validate()
 	}
-	tailnetName := os.Getenv("TAILNET_NAME")
-	if tailnetName == "" {
-		log.Fatal("Please, provide a TAILNET_NAME option")
+	if err != nil {
+		log.Fatalf("invalid configuration: %s", err)
 	}
 
-	app := AppConfig{
-		TailNetName:          tailnetName,
-		ClientId:             clientId,
-		ClientSecret:         clientSecret,
-		LogMetrics:           map[string]*prometheus.CounterVec{},
-		APIMetrics:           map[string]*prometheus.GaugeVec{},
-		SleepIntervalSeconds: *waitTimeSecs,
-		LMData:               &LogMetricData{},
+	transport, err := newAPITransport(*caBundle, *apiProxy)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if *resolveNames {
-		client := app.getOAuthClient()
-		app.NamesByAddr = mustMakeNamesByAddr(&tailnetName, client)
+	e := &exporter{
+		Health:      newHealthTracker(*staleFactor),
+		MetricsPath: cfg.Sinks.Prometheus.Path,
+		StateFile:   *stateFile,
+		ConfigFile:  *configFile,
+		configBase:  base,
+	}
+	for _, tc := range cfg.tailnets() {
+		a := &AppConfig{
+			APIBaseURL:        *apiURL,
+			TokenURL:          *tokenURL,
+			Transport:         transport.forTailnet(tc.Name),
+			TailNetName:       tc.Name,
+			Labels:            cfg.Labels,
+			MaxResponseBytes:  int64(*maxResponseMB) << 20,
+			LogWindowSeconds:  *logWindowSecs,
+			LogFetchers:       *logFetchers,
+			LogDelaySeconds:   *logDelaySecs,
+			LogOverlapSeconds: *logOverlapSecs,
+			LMData:            &LogMetricData{Tailnet: tc.Name},
+			Names:             &nameResolver{Tailnet: tc.Name},
+			Health:            e.Health,
+		}
+		// applyConfig sets the intervals of the loops
+		a.Health.Expect(a.subsystem(logsLoop), 0)
+		a.Health.Expect(a.subsystem(devicesLoop), 0)
+		a.LMData.Init()
+		e.Tailnets = append(e.Tailnets, a)
+	}
+	e.registerMetrics()
+	if err := e.applyConfig(cfg); err != nil {
+		log.Fatal(err)
 	}
 
-	app.LMData.Init()
-
-	app.addHandlers()
-	app.registerLogMetrics()
-	app.registerAPIMetrics()
-
-	go app.produceLogDataLoop()
-	go app.produceAPIDataLoop()
+	for _, a := range e.Tailnets {
+		if a.ResolveNames {
+			client := a.getOAuthClient(ctx)
+			if err := a.Names.Resolve(ctx, a.apiBaseURL(), a.TailNetName, client); err != nil {
+				log.Printf("%s: error resolving names, using IP addresses until the next name refresh: %s", a.TailNetName, err)
+			}
+		}
+	}
 
-	if *regularServer {
-		log.Printf("starting regular server on %s", *addr)
-		if err := http.ListenAndServe(*addr, nil); err != nil {
-			panic(err)
+	if e.StateFile != "" {
+		st, err := loadState(e.StateFile)
+		if err != nil {
+			log.Fatalf("error loading state from %s: %s", e.StateFile, err)
+		}
+		if err := e.restoreState(st); err != nil {
+			log.Fatalf("error restoring state from %s: %s", e.StateFile, err)
+		}
+		for _, a := range e.Tailnets {
+			log.Printf("%s: resuming network logs from %s", a.TailNetName, a.Cursor.Format(logApiDateFormat))
 		}
+	}
+
+	var ln net.Listener
+	listen := cfg.Listen
+	if listen.Mode == listenRegular {
+		log.Printf("starting regular server on %s", listen.Addr)
+		ln, err = net.Listen("tcp", listen.Addr)
 	} else {
 		log.Printf("listening in the tailnet")
-		s := new(tsnet.Server)
-		s.Hostname = *hostname
-		s.Logf = log.New(os.Stderr, fmt.Sprintf("[tsnet:%s] ", *hostname), log.LstdFlags).Printf
-		defer s.Close()
+		e.Server = new(tsnet.Server)
+		e.Server.Hostname = listen.Hostname
+		e.Server.Logf = log.New(os.Stderr, fmt.Sprintf("[tsnet:%s] ", listen.Hostname), log.LstdFlags).Printf
+		ln, err = e.Server.Listen("tcp", listen.Addr)
+		log.Printf("starting server on %s", listen.Addr)
+	}
+	if err == nil {
+		err = e.run(ctx, ln)
+	}
 
-		ln, err := s.Listen("tcp", *addr)
-		if err != nil {
-			log.Fatal(err)
+	// log.Fatal does not run deferred calls, close the tsnet server first
+	// so the node does not linger in the tailnet.
+	if e.Server != nil {
+		if err := e.Server.Close(); err != nil {
+			log.Printf("error closing tsnet server: %s", err)
 		}
-		if ln == nil {
-			log.Fatal("ln is nil")
-		}
-		defer ln.Close()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("bye")
+}
+
+// loops are the collection loops of the tailnet.
+func (a *AppConfig) loops() []func(context.Context) {
+	return []func(context.Context){
+		func(ctx context.Context) { a.pollLoop(ctx, logsLoop, a.pollLogs) },
+		func(ctx context.Context) { a.pollLoop(ctx, devicesLoop, a.pollDevices) },
+		func(ctx context.Context) {
+			// The names were resolved on startup
+			if a.waitNextPoll(ctx, namesLoop) {
+				a.pollLoop(ctx, namesLoop, a.pollNames)
+			}
+		},
+	}
+}
+
+// sleepCtx sleeps for d or until ctx is done. It reports whether the full
+// sleep happened.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// pollLogs fetches and aggregates the network logs since the cursor.
+func (a *AppConfig) pollLogs(ctx context.Context) error {
+	client := a.getOAuthClient(ctx)
+	a.cfgMu.RLock()
+	a.LMData.apply(a.logSettings)
+	a.cfgMu.RUnlock()
+	err := a.getNewLogData(ctx, client)
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	a.consumeNewLogData()
+	return err
+}
 
-		log.Printf("starting server on %s", *addr)
-		log.Fatal(http.Serve(ln, nil))
+func (a *AppConfig) apiBaseURL() string {
+	if a.APIBaseURL == "" {
+		return defaultAPIBaseURL
 	}
+	return strings.TrimSuffix(a.APIBaseURL, "/")
 }
 
-func (a *AppConfig) produceLogDataLoop() {
-	log.Printf("log loop: starting\n")
-	for {
-		client := a.getOAuthClient()
-		a.getNewLogData(client)
-		a.consumeNewLogData()
-		log.Printf("log loop: sleeping for %d secs", a.SleepIntervalSeconds)
-		time.Sleep(time.Duration(a.SleepIntervalSeconds) * time.Second)
+func (a *AppConfig) tokenURL() string {
+	if a.TokenURL == "" {
+		return a.apiBaseURL() + "/oauth/token"
 	}
+	return a.TokenURL
 }
 
-func (a *AppConfig) getOAuthClient() *http.Client {
+func (a *AppConfig) getOAuthClient(ctx context.Context) *http.Client {
+	a.cfgMu.RLock()
 	var oauthConfig = &clientcredentials.Config{
 		ClientID:     a.ClientId,
 		ClientSecret: a.ClientSecret,
-		TokenURL:     "https://api.tailscale.com/api/v2/oauth/token",
+		TokenURL:     a.tokenURL(),
+	}
+	a.cfgMu.RUnlock()
+	transport := a.Transport
+	if transport == nil {
+		transport = newRetryTransport(http.DefaultTransport).forTailnet(a.TailNetName)
+	}
+	// Both the token requests and the API requests go through the
+	// same transport.
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: transport})
+	return oauthConfig.Client(ctx)
+}
+
+// logOverlap is how far before the cursor the log windows start.
+func (a *AppConfig) logOverlap() time.Duration {
+	return time.Duration(a.LogOverlapSeconds) * time.Second
+}
+
+// logWindow returns the time range to query the network logs for. It starts
+// at the cursor (LogOverlapSeconds before it) so there are no gaps between
+// polls, and ends LogDelaySeconds before now. Without a cursor (first run)
+// we go back one logs interval.
+func (a *AppConfig) logWindow(now time.Time) (time.Time, time.Time) {
+	end := now.Add(-time.Duration(a.LogDelaySeconds) * time.Second)
+	if a.Cursor.IsZero() {
+		return end.Add(-a.schedule(logsLoop).Interval), end
 	}
-	return oauthConfig.Client(context.Background())
+	return a.Cursor.Add(-a.logOverlap()), end
+}
+
+// advanceCursor moves the cursor to newest, the Logged timestamp of the
+// newest message ingested. If the window had no messages (newest is zero) we
+// move it to the end of the window so it does not keep growing on an idle
+// tailnet; the end is far enough behind now that nothing logged before it
+// can still show up. It never moves back, a window of the overlap can end
+// before it. The messages no window can return again are forgotten.
+func (a *AppConfig) advanceCursor(newest, end time.Time) {
+	if newest.IsZero() {
+		newest = end
+	}
+	if newest.After(a.Cursor) {
+		a.Cursor = newest
+	}
+	a.LMData.Forget(a.Cursor.Add(-a.logOverlap()))
 }
 
 // Iterate over the metrics data structure and update metrics as necessary
-func (a *AppConfig) getNewLogData(client LogClient) {
+func (a *AppConfig) getNewLogData(ctx context.Context, client LogClient) error {
 	now := time.Now()
-	start := now.Add(-time.Duration(a.SleepIntervalSeconds) * time.Minute).Format(logApiDateFormat)
-	end := now.Format(logApiDateFormat)
-	apiUrl := fmt.Sprintf("https://api.tailscale.com/api/v2/tailnet/%s/network-logs?start=%s&end=%s", a.TailNetName, start, end)
-	resp, err := client.Get(apiUrl)
+	if a.now != nil {
+		now = a.now()
+	}
+	startTime, endTime := a.logWindow(now.UTC())
+	if !startTime.Before(endTime) {
+		// Polled again within the delay
+		return nil
+	}
+
+	var st ingestStats
+	defer func() { a.LMData.RecordIngest(st) }()
+
+	windows := splitWindow(startTime, endTime, time.Duration(a.LogWindowSeconds)*time.Second)
+	if len(windows) > 1 {
+		return a.fetchSubWindows(ctx, client, windows, &st)
+	}
+
+	// Messages are aggregated as they are decoded. If the response breaks
+	// halfway the cursor stays put and the next poll fetches the window
+	// again, the messages we got this time are skipped as duplicates.
+	var newest time.Time
+	err := a.fetchLogs(ctx, client, startTime, endTime, func(msg *Message) {
+		a.ingestMessage(msg, &st, &newest)
+	})
 	if err != nil {
-		log.Printf("error getNewLogData(): %s %v", apiUrl, err)
+		return err
+	}
+	a.advanceCursor(newest, endTime)
+	return nil
+}
+
+// ingestMessage aggregates msg if it is new and keeps track of the newest
+// Logged timestamp ingested. The message set tells the messages of the
+// overlap apart, except the ones counted before a restart.
+func (a *AppConfig) ingestMessage(msg *Message, st *ingestStats, newest *time.Time) {
+	if !a.resumedAt.IsZero() && !msg.Logged.After(a.resumedAt) {
+		st.dups++
 		return
 	}
+	a.LMData.SaveMessage(msg, st)
+	if msg.Logged.After(*newest) {
+		*newest = msg.Logged
+	}
+}
+
+// fetchLogs queries the network logs logged between startTime and endTime
+// and calls fn with every message as it is decoded.
+func (a *AppConfig) fetchLogs(ctx context.Context, client LogClient, startTime, endTime time.Time, fn func(*Message)) error {
+	start := startTime.UTC().Format(logApiDateFormat)
+	end := endTime.UTC().Format(logApiDateFormat)
+	apiUrl := fmt.Sprintf("%s/tailnet/%s/network-logs?start=%s&end=%s", a.apiBaseURL(), a.TailNetName, start, end)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiUrl, nil)
+	if err != nil {
+		return err
+	}
+	// Setting Accept-Encoding ourselves turns off the transparent
+	// decompression of the transport, we gunzip below.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		return transportError(fmt.Errorf("getNewLogData(): %s %w", apiUrl, err))
+	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("error getNewLogData(): Unexpected status code: %d", resp.StatusCode)
-		return
+		return httpStatusError(resp.StatusCode, fmt.Errorf("getNewLogData(): Unexpected status code: %d", resp.StatusCode))
 	}
 
-	// Read the response body
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("error getNewLogData(): Failed to read response body: %v", err)
-		return
+	var body io.Reader = resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return decodeError(fmt.Errorf("getNewLogData(): Failed to read gzip response: %w", err))
+		}
+		defer gz.Close()
+		body = gz
+	}
+	if a.MaxResponseBytes > 0 {
+		body = &maxBytesReader{r: body, max: a.MaxResponseBytes}
 	}
 
-	// Unmarshal the JSON data into the struct
-	var apiResponse APILogResponse
-	err = json.Unmarshal(body, &apiResponse)
+	err = decodeLogs(body, fn)
+	if errors.Is(err, errResponseTooLarge) {
+		return tooLargeError(fmt.Errorf("getNewLogData(): %w, raise --max-response-mb or lower --log-window-secs", err))
+	}
 	if err != nil {
-		log.Printf("error getNewLogData(): Failed to unmarshal JSON response: %v", err)
-		return
+		return decodeError(fmt.Errorf("getNewLogData(): Failed to decode JSON response: %w", err))
 	}
-
-	a.LMData.SaveNewData(apiResponse)
+	return nil
 }
 
+// consumeNewLogData adds the data aggregated since the last call to the
+// counters. The cursor saved with them moves along.
 func (a *AppConfig) consumeNewLogData() {
-	log.Printf("consuming new log metric data\n")
-	// Iterate over all the counters and update them with the data
-	for name, counter := range a.LogMetrics {
-		a.LMData.AddCounter(name, counter, a.NamesByAddr)
+	a.savedCursor = a.Cursor
+	namesByNode := a.Names.NamesByNode()
+	// Even without messages, so the reporters follow the devices
+	a.Reporters.Add(a.LMData.reporters, namesByNode)
+	if len(a.LMData.data) == 0 && len(a.LMData.reporters) == 0 {
+		return
 	}
+	log.Printf("consuming new log metric data\n")
+	// Update all the counters with the data
+	a.recordFolded(a.Traffic.Add(a.LMData.data, a.Names.NamesByAddr(), namesByNode))
 	// We have updated the prometheus counters, reset the counters in the
 	// data structure. We do so because these are counters so we are always
 	// adding to them.
 	a.LMData.Init()
 }
 
-func (a *AppConfig) registerLogMetrics() {
-	labels := []string{"src", "dst", "traffic_type", "proto"}
-	n := "tailscale_tx_bytes"
-	a.LogMetrics[n] = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: n,
-		Help: "Total number of bytes transmitted",
-	}, labels)
-
-	n = "tailscale_rx_bytes"
-	a.LogMetrics[n] = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: n,
-		Help: "Total number of bytes received",
-	}, labels)
-
-	n = "tailscale_tx_packets"
-	a.LogMetrics[n] = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: n,
-		Help: "Total number of packets transmitted",
-	}, labels)
-
-	n = "tailscale_rx_packets"
-	a.LogMetrics[n] = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: n,
-		Help: "Total number of packets received",
-	}, labels)
-
-	for name := range a.LogMetrics {
-		prometheus.MustRegister(a.LogMetrics[name])
+// recordFolded updates the series metrics after n traffic series were
+// folded.
+func (a *AppConfig) recordFolded(n int) {
+	if n > 0 {
+		log.Printf("%s: folded %d traffic series into other, over the series budget", a.TailNetName, n)
 	}
+	trafficSeriesFolded.WithLabelValues(a.TailNetName).Add(float64(n))
+	trafficSeries.WithLabelValues(a.TailNetName).Set(float64(a.Traffic.Len()))
 }
 
-func (a *AppConfig) registerAPIMetrics() {
-	labels := []string{"hostname", "update_available", "os", "is_external", "user", "client_version"}
-	n := "tailscale_hosts"
-	a.APIMetrics[n] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: n,
-		Help: "Hosts in the tailnet",
-	}, labels)
-	prometheus.MustRegister(a.APIMetrics[n])
+// registerMetrics creates the collectors of the tailnet metrics and
+// registers them with reg, labeled with the tailnet.
+func (a *AppConfig) registerMetrics(reg prometheus.Registerer) {
+	a.Traffic = newTrafficCollector(a.Labels)
+	a.Devices = newDeviceCollector()
+	a.Reporters = newReporterCollector()
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{"tailnet": a.TailNetName}, reg)
+	reg.MustRegister(a.Traffic, a.Devices, a.Reporters)
 }
 
-func (a *AppConfig) produceAPIDataLoop() {
-	for {
-		log.Printf("produceAPIDataLoop(): getting data")
-		client, err := tscg.NewClient(
-			"",
-			a.TailNetName,
-			tscg.WithOAuthClientCredentials(a.ClientId, a.ClientSecret, nil),
-		)
-		if err != nil {
-			log.Fatalf("error: %s", err)
-		}
-		a.updateAPIMetrics(client)
-		log.Printf("produceAPIDataLoop(): sleeping for %d secs", a.SleepIntervalSeconds)
-		time.Sleep(time.Duration(a.SleepIntervalSeconds) * time.Second)
-	}
+// pollDevices refreshes the device metrics.
+func (a *AppConfig) pollDevices(ctx context.Context) error {
+	client := &devicesClient{a.getOAuthClient(ctx), a.apiBaseURL(), a.TailNetName}
+	return a.updateAPIMetrics(ctx, client)
 }
 
-func (a *AppConfig) updateAPIMetrics(client APIClient) {
-	devices, err := client.Devices(context.Background())
-	if err != nil {
-		log.Printf("produceAPIDataLoop() error: %s", err)
-		return
+// pollNames refreshes the mapping of addresses to names, if we resolve
+// them.
+func (a *AppConfig) pollNames(ctx context.Context) error {
+	a.cfgMu.RLock()
+	resolveNames := a.ResolveNames
+	a.cfgMu.RUnlock()
+	if !resolveNames {
+		return nil
 	}
-
-	for _, d := range devices {
-		a.APIMetrics["tailscale_hosts"].WithLabelValues(
-			d.Hostname,
-			strconv.FormatBool(d.UpdateAvailable),
-			d.OS,
-			strconv.FormatBool(d.IsExternal),
-			d.User,
-			d.ClientVersion,
-		).Set(1)
+	err := a.Names.Resolve(ctx, a.apiBaseURL(), a.TailNetName, a.getOAuthClient(ctx))
+	if err != nil {
+		return fmt.Errorf("keeping the previous names: %w", err)
 	}
+	return nil
 }
 
-func (a *AppConfig) addHandlers() {
-	http.Handle("/metrics", promhttp.Handler())
+func (a *AppConfig) updateAPIMetrics(ctx context.Context, client APIClient) error {
+	devices, err := client.Devices(ctx)
+	if err != nil {
+		return err
+	}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "ok")
-	})
+	a.Devices.Set(devices)
+	return nil
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+)
+
+// messageKey identifies a network log message. A node reports a given
+// traffic window once, so the node plus the window plus the time the
+// logs service recorded it is enough to tell two copies apart.
+type messageKey struct {
+	NodeID string
+	Start  int64
+	End    int64
+	Logged int64
+}
+
+func newMessageKey(msg *Message) messageKey {
+	return messageKey{
+		NodeID: msg.NodeID,
+		Start:  msg.Start.UnixNano(),
+		End:    msg.End.UnixNano(),
+		Logged: msg.Logged.UnixNano(),
+	}
+}
+
+// messageSet remembers the messages already ingested so the ones the API
+// hands back again (window edges, the overlap) are not counted twice.
+// Entries are only forgotten once no window can return them again, see
+// Forget, so it holds the messages logged since the start of the next
+// window.
+type messageSet struct {
+	seen map[messageKey]struct{}
+}
+
+func newMessageSet() *messageSet {
+	return &messageSet{seen: make(map[messageKey]struct{})}
+}
+
+// Add records the message and reports whether it was new.
+func (s *messageSet) Add(msg *Message) bool {
+	k := newMessageKey(msg)
+	if _, ok := s.seen[k]; ok {
+		return false
+	}
+	s.seen[k] = struct{}{}
+	return true
+}
+
+func (s *messageSet) Len() int {
+	return len(s.seen)
+}
+
+// Forget drops the messages logged before t.
+func (s *messageSet) Forget(t time.Time) {
+	before := t.UnixNano()
+	for k := range s.seen {
+		if k.Logged < before {
+			delete(s.seen, k)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// portLabel is the value of the dst_port or src_port label of a traffic
+// series: a port of the allowlist or one of the buckets below. It is a
+// number so LogEntry stays cheap to hash.
+type portLabel uint32
+
+const (
+	// noPort is traffic without a port (ICMP, some exit traffic) and the
+	// value of the port labels that are not exported.
+	noPort portLabel = 0
+	// otherPort and ephemeralPort are the ports not in the allowlist,
+	// below and above ephemeralPortStart.
+	otherPort     portLabel = 1 << 16
+	ephemeralPort portLabel = 1<<16 + 1
+)
+
+// ephemeralPortStart is where the ephemeral ports start on Linux (IANA's
+// range starts higher, at 49152). Clients pick their source port there,
+// they are not worth a label value each.
+const ephemeralPortStart = 32768
+
+func (p portLabel) String() string {
+	switch p {
+	case noPort:
+		return "-"
+	case otherPort:
+		return "other"
+	case ephemeralPort:
+		return "ephemeral"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// defaultPorts are the ports of --ports, well known services worth telling
+// apart.
+var defaultPorts = []uint16{22, 53, 80, 443, 3306, 3389, 5432, 6379, 8080, 8443}
+
+// defaultServices are the services the service label knows by port,
+// labels.services adds to them.
+var defaultServices = map[uint16]string{
+	22:    "ssh",
+	25:    "smtp",
+	53:    "dns",
+	80:    "http",
+	123:   "ntp",
+	143:   "imap",
+	443:   "https",
+	445:   "smb",
+	993:   "imaps",
+	3306:  "mysql",
+	3389:  "rdp",
+	5432:  "postgres",
+	5900:  "vnc",
+	6379:  "redis",
+	6443:  "kubernetes",
+	8080:  "http-alt",
+	8443:  "https-alt",
+	9100:  "node-exporter",
+	27017: "mongodb",
+	41641: "tailscale",
+}
+
+// services returns the service names by port of the service label.
+func (c *LabelsConfig) services() map[uint16]string {
+	services := maps.Clone(defaultServices)
+	maps.Copy(services, c.Services)
+	return services
+}
+
+// portLabeler turns the ports of the traffic into port labels. The zero
+// value labels nothing.
+type portLabeler struct {
+	src, dst bool
+	allow    map[uint16]bool
+	// services are the ports of the service label, nil without it
+	services map[uint16]string
+}
+
+func newPortLabeler(labels LabelsConfig) portLabeler {
+	p := portLabeler{src: labels.SrcPort, dst: labels.DstPort, allow: map[uint16]bool{}}
+	for _, port := range labels.Ports {
+		p.allow[port] = true
+	}
+	if labels.Service {
+		p.services = labels.services()
+	}
+	return p
+}
+
+// service returns the port of the service of a connection between the
+// ports src and dst: dst if it is a known service, else src (the reply
+// of a server). otherPort when neither is known, noPort without the
+// service label.
+func (p portLabeler) service(src, dst uint16) portLabel {
+	switch {
+	case p.services == nil || (src == 0 && dst == 0):
+		return noPort
+	case p.services[dst] != "":
+		return portLabel(dst)
+	case p.services[src] != "":
+		return portLabel(src)
+	}
+	return otherPort
+}
+
+// serviceLabel is the value of the service label of port, as returned by
+// portLabeler.service.
+func serviceLabel(port portLabel, services map[uint16]string) string {
+	if name, ok := services[uint16(port)]; ok && port < otherPort {
+		return name
+	}
+	return port.String()
+}
+
+// label returns the label of port, noPort when on is false.
+func (p portLabeler) label(port uint16, on bool) portLabel {
+	switch {
+	case !on || port == 0:
+		return noPort
+	case p.allow[port]:
+		return portLabel(port)
+	case port >= ephemeralPortStart:
+		return ephemeralPort
+	}
+	return otherPort
+}
+
+// portList is a flag with a comma separated list of ports.
+type portList []uint16
+
+// portListFlag defines a portList flag with value as its default.
+func portListFlag(name string, value []uint16, usage string) *portList {
+	p := portList(value)
+	flag.Var(&p, name, usage)
+	return &p
+}
+
+func (p *portList) String() string {
+	s := make([]string, len(*p))
+	for i, port := range *p {
+		s[i] = strconv.Itoa(int(port))
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *portList) Set(s string) error {
+	var ports []uint16
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(f, 10, 16)
+		if err != nil || port == 0 {
+			return fmt.Errorf("invalid port %q", f)
+		}
+		ports = append(ports, uint16(port))
+	}
+	*p = ports
+	return nil
+}
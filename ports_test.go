@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPortLabeler(t *testing.T) {
+	c := qt.New(t)
+	p := newPortLabeler(LabelsConfig{DstPort: true, Ports: []uint16{22, 443}})
+	c.Assert(p.label(22, p.dst).String(), qt.Equals, "22")
+	c.Assert(p.label(443, p.dst).String(), qt.Equals, "443")
+	c.Assert(p.label(8080, p.dst).String(), qt.Equals, "other")
+	c.Assert(p.label(51234, p.dst).String(), qt.Equals, "ephemeral")
+	c.Assert(p.label(0, p.dst).String(), qt.Equals, "-")
+	// src_port is off
+	c.Assert(p.label(22, p.src), qt.Equals, noPort)
+	c.Assert(portLabeler{}.label(22, true), qt.Equals, otherPort)
+}
+
+func TestPortList(t *testing.T) {
+	c := qt.New(t)
+	var p portList
+	c.Assert(p.Set("22, 443,,5432"), qt.IsNil)
+	c.Assert(p, qt.DeepEquals, portList{22, 443, 5432})
+	c.Assert(p.String(), qt.Equals, "22,443,5432")
+	c.Assert(p.Set("22,70000"), qt.ErrorMatches, `invalid port "70000"`)
+	c.Assert(p.Set("0"), qt.ErrorMatches, `invalid port "0"`)
+}
+
+func TestTrafficCollectorPorts(t *testing.T) {
+	c := qt.New(t)
+	labels := LabelsConfig{DstPort: true, Ports: []uint16{22, 5432}}
+	mData := LogMetricData{Ports: newPortLabeler(labels)}
+	mData.Init()
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50001", "100.2.2.2:22", 1, 10, 1, 10}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50002", "100.2.2.2:22", 1, 10, 1, 10}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50003", "100.2.2.2:5432", 1, 20, 1, 20}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50004", "100.2.2.2:9999", 1, 30, 1, 30}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{6, "100.2.2.2:22", "100.1.1.1:50001", 1, 40, 1, 40}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{1, "100.1.1.1", "100.2.2.2", 1, 50, 1, 50}, VirtualTraffic, "")
+	// The source ports are not labeled, SSH is one series
+	c.Assert(mData.data, qt.HasLen, 5)
+
+	tc := newTrafficCollector(labels)
+	tc.Add(mData.data, nil, nil)
+	want := `
+# HELP tailscale_tx_bytes Total number of bytes transmitted
+# TYPE tailscale_tx_bytes counter
+tailscale_tx_bytes{dst="100.1.1.1",dst_port="ephemeral",proto="tcp",src="100.2.2.2",traffic_type="virtual"} 40
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="-",proto="icmp",src="100.1.1.1",traffic_type="virtual"} 50
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="22",proto="tcp",src="100.1.1.1",traffic_type="virtual"} 20
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="5432",proto="tcp",src="100.1.1.1",traffic_type="virtual"} 20
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="other",proto="tcp",src="100.1.1.1",traffic_type="virtual"} 30
+`
+	c.Assert(testutil.CollectAndCompare(tc, strings.NewReader(want), "tailscale_tx_bytes"), qt.IsNil)
+
+	// The state of the counters keeps the ports
+	restored := newTrafficCollector(labels)
+	for metric, samples := range tc.Samples() {
+		for _, sample := range samples {
+			c.Assert(restored.Restore(metric, sample), qt.IsNil)
+		}
+	}
+	c.Assert(restored.series, qt.DeepEquals, tc.series)
+}
+
+func TestTrafficCollectorService(t *testing.T) {
+	c := qt.New(t)
+	labels := LabelsConfig{DstPort: true, Service: true, Ports: []uint16{22}, Services: map[uint16]string{9999: "myapp", 22: "git"}}
+	mData := LogMetricData{Ports: newPortLabeler(labels)}
+	mData.Init()
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50001", "100.2.2.2:22", 1, 10, 1, 10}, VirtualTraffic, "")
+	// The reply of the server is the same service
+	mData.Update(&ConnectionCounts{6, "100.2.2.2:22", "100.1.1.1:50001", 1, 20, 1, 20}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50002", "100.2.2.2:9999", 1, 30, 1, 30}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{6, "100.1.1.1:50003", "100.2.2.2:443", 1, 40, 1, 40}, VirtualTraffic, "")
+	mData.Update(&ConnectionCounts{17, "100.1.1.1:50004", "100.2.2.2:7777", 1, 50, 1, 50}, VirtualTraffic, "")
+
+	tc := newTrafficCollector(labels)
+	tc.Add(mData.data, nil, nil)
+	want := `
+# HELP tailscale_tx_bytes Total number of bytes transmitted
+# TYPE tailscale_tx_bytes counter
+tailscale_tx_bytes{dst="100.1.1.1",dst_port="ephemeral",proto="tcp",service="git",src="100.2.2.2",traffic_type="virtual"} 20
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="22",proto="tcp",service="git",src="100.1.1.1",traffic_type="virtual"} 10
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="other",proto="tcp",service="https",src="100.1.1.1",traffic_type="virtual"} 40
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="other",proto="tcp",service="myapp",src="100.1.1.1",traffic_type="virtual"} 30
+tailscale_tx_bytes{dst="100.2.2.2",dst_port="other",proto="udp",service="other",src="100.1.1.1",traffic_type="virtual"} 50
+`
+	c.Assert(testutil.CollectAndCompare(tc, strings.NewReader(want), "tailscale_tx_bytes"), qt.IsNil)
+}
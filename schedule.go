@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// schedule is when a collection loop polls.
+type schedule struct {
+	// Interval is the time between polls.
+	Interval time.Duration
+	// Jitter delays every poll by a random amount up to Jitter, so a
+	// fleet of exporters does not hit the API at the same time.
+	Jitter time.Duration
+	// Align starts the polls at multiples of Interval on the wall clock
+	// (UTC), plus the jitter, instead of Interval after the previous one.
+	Align bool
+}
+
+// next returns when the poll after one that finished at now is due.
+func (s schedule) next(now time.Time) time.Time {
+	t := now.Add(s.Interval)
+	if s.Align {
+		t = now.Truncate(s.Interval).Add(s.Interval)
+	}
+	if s.Jitter > 0 {
+		t = t.Add(rand.N(s.Jitter))
+	}
+	return t
+}
+
+// period is the longest time between the start of two polls, not counting
+// how long they take.
+func (s schedule) period() time.Duration {
+	return s.Interval + s.Jitter
+}
+
+// schedule returns the schedule of a loop. A loop without one uses the
+// logs schedule.
+func (a *AppConfig) schedule(loop string) schedule {
+	a.cfgMu.RLock()
+	defer a.cfgMu.RUnlock()
+	if s, ok := a.Schedules[loop]; ok {
+		return s
+	}
+	return a.Schedules[logsLoop]
+}
+
+// subsystem is the name of a loop in the health endpoints.
+func (a *AppConfig) subsystem(loop string) string {
+	return a.TailNetName + "/" + loop
+}
+
+// pollLoop calls poll on the schedule of loop until ctx is done, keeping
+// the poll metrics and the health of the loop.
+func (a *AppConfig) pollLoop(ctx context.Context, loop string, poll func(context.Context) error) {
+	log.Printf("%s %s loop: starting", a.TailNetName, loop)
+	for {
+		start := time.Now()
+		err := poll(ctx)
+		if ctx.Err() != nil {
+			// Interrupted by the shutdown, not a failure.
+			return
+		}
+		recordPoll(a.TailNetName, loop, start, err)
+		a.Health.Record(a.subsystem(loop), err)
+		if err != nil {
+			log.Printf("%s %s loop: error: %s", a.TailNetName, loop, err)
+		}
+		if !a.waitNextPoll(ctx, loop) {
+			return
+		}
+	}
+}
+
+// waitNextPoll sleeps until the next poll of loop is due. It reports
+// whether it did, false if ctx is done first.
+func (a *AppConfig) waitNextPoll(ctx context.Context, loop string) bool {
+	next := a.schedule(loop).next(time.Now())
+	nextPoll.WithLabelValues(a.TailNetName, loop).Set(float64(next.Unix()))
+	log.Printf("%s %s loop: next poll at %s", a.TailNetName, loop, next.Format(time.RFC3339))
+	return sleepCtx(ctx, time.Until(next))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScheduleNext(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2022, 10, 28, 22, 41, 17, 0, time.UTC)
+
+	c.Assert(schedule{Interval: time.Minute}.next(now), qt.Equals, now.Add(time.Minute))
+	aligned := schedule{Interval: time.Minute, Align: true}
+	c.Assert(aligned.next(now), qt.Equals, time.Date(2022, 10, 28, 22, 42, 0, 0, time.UTC))
+	// A poll that ends right on the boundary waits for the next one
+	c.Assert(aligned.next(time.Date(2022, 10, 28, 22, 42, 0, 0, time.UTC)), qt.Equals, time.Date(2022, 10, 28, 22, 43, 0, 0, time.UTC))
+	c.Assert(schedule{Interval: 5 * time.Minute, Align: true}.next(now), qt.Equals, time.Date(2022, 10, 28, 22, 45, 0, 0, time.UTC))
+
+	jittered := schedule{Interval: time.Minute, Jitter: 10 * time.Second, Align: true}
+	c.Assert(jittered.period(), qt.Equals, 70*time.Second)
+	seen := map[time.Time]bool{}
+	for range 100 {
+		next := jittered.next(now)
+		c.Assert(next.Before(time.Date(2022, 10, 28, 22, 42, 0, 0, time.UTC)), qt.IsFalse)
+		c.Assert(next.Before(time.Date(2022, 10, 28, 22, 42, 10, 0, time.UTC)), qt.IsTrue)
+		seen[next] = true
+	}
+	c.Assert(len(seen) > 1, qt.IsTrue)
+}
+
+func TestPollLoop(t *testing.T) {
+	c := qt.New(t)
+	a := &AppConfig{
+		TailNetName: "dummy",
+		Schedules: map[string]schedule{
+			logsLoop:    {Interval: time.Hour},
+			devicesLoop: {Interval: time.Millisecond},
+		},
+		Health: newHealthTracker(3),
+	}
+	a.Health.Expect(a.subsystem(devicesLoop), time.Millisecond)
+	// names has no schedule, it polls on the logs one
+	c.Assert(a.schedule(namesLoop), qt.Equals, a.Schedules[logsLoop])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	polls := 0
+	failures := testutil.ToFloat64(pollErrors.WithLabelValues(a.TailNetName, devicesLoop, "other"))
+	a.pollLoop(ctx, devicesLoop, func(context.Context) error {
+		polls++
+		if polls == 3 {
+			cancel()
+		}
+		if polls == 1 {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	c.Assert(polls, qt.Equals, 3)
+	c.Assert(testutil.ToFloat64(pollErrors.WithLabelValues(a.TailNetName, devicesLoop, "other")), qt.Equals, failures+1)
+	c.Assert(testutil.ToFloat64(nextPoll.WithLabelValues(a.TailNetName, devicesLoop)) > 0, qt.IsTrue)
+	resp, _ := a.Health.check()
+	c.Assert(resp.Subsystems[a.subsystem(devicesLoop)].LastError, qt.Equals, "boom")
+	c.Assert(resp.Subsystems[a.subsystem(devicesLoop)].LastSuccess.IsZero(), qt.IsFalse)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Names of the collection loops, used as the loop label.
+const (
+	logsLoop    = "logs"
+	devicesLoop = "devices"
+	namesLoop   = "names"
+)
+
+// Metrics about tsmetrics itself so we can tell if the loops are working
+// without reading the logs. The ones about a tailnet carry its tailnet
+// label.
+var (
+	pollDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tsmetrics_poll_duration_seconds",
+		Help:    "Time spent polling the Tailscale API, by loop",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"tailnet", "loop"})
+
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful poll, by loop",
+	}, []string{"tailnet", "loop"})
+
+	pollErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsmetrics_poll_errors_total",
+		Help: "Failed polls by loop and kind of error (http_<status>, decode, too_large, transport)",
+	}, []string{"tailnet", "loop", "kind"})
+
+	messagesIngested = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsmetrics_messages_ingested_total",
+		Help: "Network log messages ingested",
+	}, []string{"tailnet"})
+
+	connectionCountsIngested = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsmetrics_connection_counts_ingested_total",
+		Help: "Network log connection counts ingested, by traffic type",
+	}, []string{"tailnet", "traffic_type"})
+
+	logMetricDataEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_log_metric_data_entries",
+		Help: "Entries aggregated in the last network logs poll",
+	}, []string{"tailnet"})
+
+	trafficSeries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_traffic_series",
+		Help: "Series of every traffic metric",
+	}, []string{"tailnet"})
+
+	trafficSeriesFolded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tsmetrics_traffic_series_folded_total",
+		Help: "Traffic series folded into other to stay within the series budget",
+	}, []string{"tailnet"})
+
+	scheduleInterval = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_schedule_interval_seconds",
+		Help: "Time between polls, by loop",
+	}, []string{"tailnet", "loop"})
+
+	scheduleJitter = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_schedule_jitter_seconds",
+		Help: "Largest random delay added to every poll, by loop",
+	}, []string{"tailnet", "loop"})
+
+	scheduleAligned = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_schedule_aligned",
+		Help: "1 if the polls are aligned to multiples of the interval on the wall clock, by loop",
+	}, []string{"tailnet", "loop"})
+
+	nextPoll = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tsmetrics_next_poll_timestamp_seconds",
+		Help: "Unix time the next poll is due, by loop",
+	}, []string{"tailnet", "loop"})
+)
+
+// exporterMetrics are the metrics about tsmetrics itself. They are shared
+// by every registry in the process.
+func exporterMetrics() []prometheus.Collector {
+	return []prometheus.Collector{
+		pollDuration,
+		lastSuccess,
+		pollErrors,
+		messagesIngested,
+		connectionCountsIngested,
+		logMetricDataEntries,
+		trafficSeries,
+		trafficSeriesFolded,
+		duplicateMessages,
+		apiRetries,
+		apiFailures,
+		namesResolved,
+		logWindowRetries,
+		configReloads,
+		scheduleInterval,
+		scheduleJitter,
+		scheduleAligned,
+		nextPoll,
+	}
+}
+
+// Kinds of poll errors.
+const (
+	transportErrorKind = "transport"
+	decodeErrorKind    = "decode"
+	tooLargeErrorKind  = "too_large"
+)
+
+// pollError is an error polling the API, classified by kind for
+// tsmetrics_poll_errors_total.
+type pollError struct {
+	kind string
+	err  error
+}
+
+func (e *pollError) Error() string {
+	return e.err.Error()
+}
+
+func (e *pollError) Unwrap() error {
+	return e.err
+}
+
+func transportError(err error) error {
+	return &pollError{transportErrorKind, err}
+}
+
+func decodeError(err error) error {
+	return &pollError{decodeErrorKind, err}
+}
+
+func tooLargeError(err error) error {
+	return &pollError{tooLargeErrorKind, err}
+}
+
+func httpStatusError(code int, err error) error {
+	return &pollError{fmt.Sprintf("http_%d", code), err}
+}
+
+// errorKind returns the kind of a poll error, "other" if it was not
+// classified.
+func errorKind(err error) string {
+	var pe *pollError
+	if errors.As(err, &pe) {
+		return pe.kind
+	}
+	return "other"
+}
+
+// recordSchedule exports the schedule of a loop of a tailnet.
+func recordSchedule(tailnet, loop string, s schedule) {
+	scheduleInterval.WithLabelValues(tailnet, loop).Set(s.Interval.Seconds())
+	scheduleJitter.WithLabelValues(tailnet, loop).Set(s.Jitter.Seconds())
+	aligned := 0.0
+	if s.Align {
+		aligned = 1
+	}
+	scheduleAligned.WithLabelValues(tailnet, loop).Set(aligned)
+}
+
+// recordPoll updates the poll metrics of a loop of a tailnet after a poll
+// that started at start.
+func recordPoll(tailnet, loop string, start time.Time, err error) {
+	now := time.Now()
+	pollDuration.WithLabelValues(tailnet, loop).Observe(now.Sub(start).Seconds())
+	if err != nil {
+		pollErrors.WithLabelValues(tailnet, loop, errorKind(err)).Inc()
+		return
+	}
+	lastSuccess.WithLabelValues(tailnet, loop).Set(float64(now.Unix()))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorKind(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(errorKind(transportError(errors.New("boom"))), qt.Equals, "transport")
+	c.Assert(errorKind(decodeError(errors.New("boom"))), qt.Equals, "decode")
+	c.Assert(errorKind(httpStatusError(429, errors.New("boom"))), qt.Equals, "http_429")
+	wrapped := fmt.Errorf("wrapped: %w", httpStatusError(503, errors.New("boom")))
+	c.Assert(errorKind(wrapped), qt.Equals, "http_503")
+	c.Assert(errorKind(errors.New("boom")), qt.Equals, "other")
+}
+
+func TestRecordPoll(t *testing.T) {
+	c := qt.New(t)
+	loop := "test-loop"
+
+	errs := testutil.ToFloat64(pollErrors.WithLabelValues("test-tailnet", loop, "http_500"))
+	success := testutil.ToFloat64(lastSuccess.WithLabelValues("test-tailnet", loop))
+	recordPoll("test-tailnet", loop, time.Now(), httpStatusError(500, errors.New("boom")))
+	c.Assert(testutil.ToFloat64(pollErrors.WithLabelValues("test-tailnet", loop, "http_500"))-errs, qt.Equals, 1.0)
+	c.Assert(testutil.ToFloat64(lastSuccess.WithLabelValues("test-tailnet", loop)), qt.Equals, success)
+
+	before := time.Now().Unix()
+	recordPoll("test-tailnet", loop, time.Now(), nil)
+	c.Assert(testutil.ToFloat64(lastSuccess.WithLabelValues("test-tailnet", loop)) >= float64(before), qt.IsTrue)
+	c.Assert(testutil.CollectAndCount(pollDuration, "tsmetrics_poll_duration_seconds") > 0, qt.IsTrue)
+}
+
+func TestIngestMetrics(t *testing.T) {
+	c := qt.New(t)
+	var resp APILogResponse
+	c.Assert(json.Unmarshal(logOne, &resp), qt.IsNil)
+
+	msgs := testutil.ToFloat64(messagesIngested.WithLabelValues("test-tailnet"))
+	virtual := testutil.ToFloat64(connectionCountsIngested.WithLabelValues("test-tailnet", "virtual"))
+	physical := testutil.ToFloat64(connectionCountsIngested.WithLabelValues("test-tailnet", "physical"))
+
+	mData := LogMetricData{Tailnet: "test-tailnet"}
+	mData.Init()
+	mData.SaveNewData(resp)
+
+	c.Assert(testutil.ToFloat64(messagesIngested.WithLabelValues("test-tailnet"))-msgs, qt.Equals, 2.0)
+	c.Assert(testutil.ToFloat64(connectionCountsIngested.WithLabelValues("test-tailnet", "virtual"))-virtual, qt.Equals, 3.0)
+	c.Assert(testutil.ToFloat64(connectionCountsIngested.WithLabelValues("test-tailnet", "physical"))-physical, qt.Equals, 3.0)
+	c.Assert(testutil.ToFloat64(logMetricDataEntries.WithLabelValues("test-tailnet")), qt.Equals, float64(len(mData.data)))
+}
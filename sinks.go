@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// textfileLoop writes the metrics to TextfilePath every
+// TextfileIntervalSeconds, in the format of the node_exporter textfile
+// collector. Both can change on a config reload; without a path it just
+// waits for one.
+func (e *exporter) textfileLoop(ctx context.Context) {
+	for {
+		e.cfgMu.RLock()
+		path := e.TextfilePath
+		interval := time.Duration(e.TextfileIntervalSeconds) * time.Second
+		e.cfgMu.RUnlock()
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		if path != "" {
+			// WriteToTextfile writes a temporary file and renames it, the
+			// collector never reads half a file.
+			if err := prometheus.WriteToTextfile(path, e.Registry); err != nil {
+				log.Printf("textfileLoop(): %s", err)
+			}
+		}
+		if !sleepCtx(ctx, interval) {
+			return
+		}
+	}
+}
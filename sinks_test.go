@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestTextfileSink(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "tsmetrics.prom")
+	e := newTestExporter()
+	e.TextfilePath = path
+	e.TextfileIntervalSeconds = 1
+	e.Tailnets[0].Traffic.Add(MapLogEntryToValue{
+		{netip.MustParseAddr("100.1.1.1"), netip.MustParseAddr("100.2.2.2"), VirtualTraffic, 6, 0, 0, 0, ""}: {TxBytes: 10},
+	}, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.textfileLoop(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	want := `tailscale_tx_bytes{dst="100.2.2.2",proto="tcp",src="100.1.1.1",tailnet="dummy",traffic_type="virtual"} 10`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(path)
+		if strings.Contains(string(b), want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.Fatalf("%s does not have %s:\n%s", path, want, b)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
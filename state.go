@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is the version of the state file format we write. Bump it
+// when the format changes and teach migrateState how to upgrade.
+//
+//	0: only the log cursor
+//	1: adds the version and the traffic counters
+//	2: the cursor and the counters of every tailnet, by name
+//	3: the proto label has the protocol name
+const stateVersion = 3
+
+// State is what we persist on disk so a restart resumes where the
+// previous run stopped.
+type State struct {
+	Version int `json:"version"`
+
+	// Tailnets holds the state of every tailnet by name.
+	Tailnets map[string]TailnetState `json:"tailnets,omitempty"`
+
+	// Cursor and Counters are the state of the only tailnet in version 1
+	// and older, migrateState moves them to Tailnets.
+	Cursor   time.Time                  `json:"cursor,omitzero"`
+	Counters map[string][]CounterSample `json:"counters,omitempty"`
+}
+
+// TailnetState is the state of one tailnet.
+type TailnetState struct {
+	// Cursor is the Logged timestamp of the last network log message we
+	// ingested. The next network-logs query starts right after it.
+	Cursor time.Time `json:"cursor"`
+
+	// Counters holds the value of every traffic series by metric name.
+	Counters map[string][]CounterSample `json:"counters,omitempty"`
+}
+
+// legacyTailnet is the key of the state of a version 1 file in Tailnets.
+// Those files do not say which tailnet it is, it goes to the only one we
+// collect.
+const legacyTailnet = ""
+
+// CounterSample is the value of one series of a CounterVec.
+type CounterSample struct {
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// loadState reads the state file. A missing file is not an error, it just
+// means this is the first run.
+func loadState(path string) (State, error) {
+	var s State
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return State{Version: stateVersion}, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, err
+	}
+	return s, migrateState(&s)
+}
+
+// migrateState upgrades a state read from disk to the current version.
+func migrateState(s *State) error {
+	if s.Version > stateVersion {
+		return fmt.Errorf("state version %d is newer than the supported version %d", s.Version, stateVersion)
+	}
+	if s.Version == 0 {
+		// Version 0 only had the cursor, nothing to convert.
+		s.Version = 1
+	}
+	if s.Version == 1 {
+		s.Tailnets = map[string]TailnetState{
+			legacyTailnet: {Cursor: s.Cursor, Counters: s.Counters},
+		}
+		s.Cursor, s.Counters = time.Time{}, nil
+		s.Version = 2
+	}
+	if s.Version == 2 {
+		for _, ts := range s.Tailnets {
+			for _, samples := range ts.Counters {
+				for _, sample := range samples {
+					if proto, ok := sample.Labels["proto"]; ok {
+						sample.Labels["proto"] = protoLabel(proto)
+					}
+				}
+			}
+		}
+		s.Version = 3
+	}
+	return nil
+}
+
+// saveState writes the state file atomically so a crash mid write never
+// leaves a truncated file behind.
+func saveState(path string, s State) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// currentState captures the cursor and the traffic counters. It has to
+// run with stateMu held so both belong to the same poll.
+func (a *AppConfig) currentState() TailnetState {
+	return TailnetState{
+		Cursor:   a.savedCursor,
+		Counters: a.Traffic.Samples(),
+	}
+}
+
+// restoreState loads a previous state into the traffic counters and the
+// cursor.
+func (a *AppConfig) restoreState(s TailnetState) error {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+
+	a.Cursor = s.Cursor
+	a.savedCursor = s.Cursor
+	a.resumedAt = s.Cursor
+	for name, samples := range s.Counters {
+		if counter(&LogCounts{}, name) == nil {
+			log.Printf("restoreState(): skipping unknown metric %s", name)
+			continue
+		}
+		for _, sample := range samples {
+			if err := a.Traffic.Restore(name, sample); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	// The budget may be smaller than in the previous run
+	a.recordFolded(a.Traffic.Fold())
+	return nil
+}
+
+// currentState captures the state of every tailnet.
+func (e *exporter) currentState() State {
+	s := State{Version: stateVersion, Tailnets: map[string]TailnetState{}}
+	for _, a := range e.Tailnets {
+		a.stateMu.Lock()
+		s.Tailnets[a.TailNetName] = a.currentState()
+		a.stateMu.Unlock()
+	}
+	return s
+}
+
+// restoreState loads a previous state into every tailnet. The state of
+// tailnets we no longer collect is dropped.
+func (e *exporter) restoreState(s State) error {
+	for name := range s.Tailnets {
+		if name != legacyTailnet && e.tailnet(name) == nil {
+			log.Printf("restoreState(): dropping the state of tailnet %s, it is not configured", name)
+		}
+	}
+	for _, a := range e.Tailnets {
+		ts, ok := s.Tailnets[a.TailNetName]
+		if !ok && len(e.Tailnets) == 1 {
+			ts, ok = s.Tailnets[legacyTailnet]
+		}
+		if !ok {
+			continue
+		}
+		if err := a.restoreState(ts); err != nil {
+			return fmt.Errorf("tailnet %s: %w", a.TailNetName, err)
+		}
+	}
+	return nil
+}
+
+func (e *exporter) saveState() {
+	if e.StateFile == "" {
+		return
+	}
+	if err := saveState(e.StateFile, e.currentState()); err != nil {
+		log.Printf("error saving state to %s: %s", e.StateFile, err)
+	}
+}
+
+// checkpointStateLoop saves the state every CheckpointIntervalSeconds. The
+// last save on shutdown is done by run().
+func (e *exporter) checkpointStateLoop(ctx context.Context) {
+	for sleepCtx(ctx, e.interval(&e.CheckpointIntervalSeconds)) {
+		e.saveState()
+	}
+}
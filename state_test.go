@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	e := newTestExporter()
+	e.StateFile = path
+	a := e.Tailnets[0]
+	a.Cursor = time.Date(2022, 10, 28, 22, 40, 0, 344979725, time.UTC)
+	a.Traffic.Add(MapLogEntryToValue{
+		{netip.MustParseAddr("100.1.1.1"), netip.MustParseAddr("100.2.2.2"), VirtualTraffic, 6, 0, 0, 0, ""}: {TxBytes: 10, RxBytes: 7},
+		{netip.MustParseAddr("100.1.1.1"), netip.MustParseAddr("10.0.0.3"), SubnetTraffic, 17, 0, 0, 0, ""}:  {TxBytes: 5},
+	}, nil, nil)
+	a.consumeNewLogData()
+	e.saveState()
+
+	st, err := loadState(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Version, qt.Equals, stateVersion)
+	c.Assert(st.Tailnets, qt.HasLen, 1)
+
+	b := newTestExporter()
+	c.Assert(b.restoreState(st), qt.IsNil)
+	c.Assert(b.Tailnets[0].Cursor.Equal(a.Cursor), qt.IsTrue)
+	c.Assert(b.Tailnets[0].Traffic.series, qt.DeepEquals, a.Traffic.series)
+
+	// Metrics we no longer export are skipped
+	st.Tailnets["dummy"].Counters["tailscale_gone"] = []CounterSample{{map[string]string{"a": "b"}, 1}}
+	c.Assert(newTestExporter().restoreState(st), qt.IsNil)
+}
+
+func TestStateTailnets(t *testing.T) {
+	c := qt.New(t)
+	cursor := time.Date(2022, 10, 28, 22, 40, 0, 0, time.UTC)
+	e := newTestExporter()
+	other := newTestApp().AppConfig
+	other.TailNetName = "other"
+	e.Tailnets = append(e.Tailnets, other)
+
+	// Every tailnet gets its own state, the unknown ones are dropped
+	c.Assert(e.restoreState(State{Version: stateVersion, Tailnets: map[string]TailnetState{
+		"other": {Cursor: cursor},
+		"gone":  {Cursor: cursor.Add(time.Hour)},
+	}}), qt.IsNil)
+	c.Assert(e.Tailnets[0].Cursor.IsZero(), qt.IsTrue)
+	c.Assert(other.Cursor.Equal(cursor), qt.IsTrue)
+	c.Assert(e.currentState().Tailnets, qt.HasLen, 2)
+
+	// A version 1 state only fits when there is one tailnet
+	legacy := State{Version: stateVersion, Tailnets: map[string]TailnetState{legacyTailnet: {Cursor: cursor}}}
+	c.Assert(e.restoreState(legacy), qt.IsNil)
+	c.Assert(e.Tailnets[0].Cursor.IsZero(), qt.IsTrue)
+	e = newTestExporter()
+	c.Assert(e.restoreState(legacy), qt.IsNil)
+	c.Assert(e.Tailnets[0].Cursor.Equal(cursor), qt.IsTrue)
+}
+
+func TestStateMigration(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+
+	// No file: first run
+	st, err := loadState(filepath.Join(dir, "missing.json"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Tailnets, qt.HasLen, 0)
+
+	// Version 0 only had the cursor
+	v0 := filepath.Join(dir, "v0.json")
+	c.Assert(os.WriteFile(v0, []byte(`{"cursor": "2022-10-28T22:40:00.344979725Z"}`), 0o600), qt.IsNil)
+	st, err = loadState(v0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Version, qt.Equals, stateVersion)
+	c.Assert(st.Tailnets[legacyTailnet].Cursor.Equal(time.Date(2022, 10, 28, 22, 40, 0, 344979725, time.UTC)), qt.IsTrue)
+
+	// Version 1 had the counters of the only tailnet
+	v1 := filepath.Join(dir, "v1.json")
+	c.Assert(os.WriteFile(v1, []byte(`{"version": 1, "cursor": "2022-10-28T22:40:00Z",
+		"counters": {"tailscale_tx_bytes": [{"labels": {"src": "a"}, "value": 3}]}}`), 0o600), qt.IsNil)
+	st, err = loadState(v1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(st.Cursor.IsZero(), qt.IsTrue)
+	c.Assert(st.Counters, qt.IsNil)
+	c.Assert(st.Tailnets[legacyTailnet].Counters["tailscale_tx_bytes"], qt.HasLen, 1)
+
+	// Version 2 had the protocol numbers
+	v2 := filepath.Join(dir, "v2.json")
+	c.Assert(os.WriteFile(v2, []byte(`{"version": 2, "tailnets": {"a.com": {"cursor": "2022-10-28T22:40:00Z",
+		"counters": {"tailscale_tx_bytes": [{"labels": {"proto": "6"}, "value": 3}, {"labels": {"proto": "0"}, "value": 1}]}}}}`), 0o600), qt.IsNil)
+	st, err = loadState(v2)
+	c.Assert(err, qt.IsNil)
+	samples := st.Tailnets["a.com"].Counters["tailscale_tx_bytes"]
+	c.Assert(samples[0].Labels["proto"], qt.Equals, "tcp")
+	c.Assert(samples[1].Labels["proto"], qt.Equals, "-")
+
+	future := filepath.Join(dir, "future.json")
+	c.Assert(os.WriteFile(future, []byte(`{"version": 999}`), 0o600), qt.IsNil)
+	_, err = loadState(future)
+	c.Assert(err, qt.ErrorMatches, "state version 999 is newer.*")
+}